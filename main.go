@@ -1,11 +1,16 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/toyCache/toyCache"
+	pb "github.com/toyCache/toyCache/toycachepb"
+	"google.golang.org/grpc"
 	"log"
+	"net"
 	"net/http"
+	"time"
 )
 
 var db = map[string]string{
@@ -20,13 +25,14 @@ func CreateGroup() *toyCache.Group {
 		if v, ok := db[key]; ok {
 			return []byte(v), nil
 		}
-		return nil, fmt.Errorf("%s not exist", key)
-	}))
+		return nil, fmt.Errorf("%s not exist: %w", key, toyCache.ErrNotFound)
+	}), toyCache.WithNegativeCache(time.Minute, time.Second))
 }
 
 func startCacheServer(addr string, addrs []string, group *toyCache.Group) {
 	peers := toyCache.NewHTTPPool(addr)
 	peers.Set(addrs...)
+	peers.StartHealthCheck(5 * time.Second)
 
 	group.RegisterPeer(peers)
 	log.Println("toyCache is running at", addr)
@@ -34,16 +40,36 @@ func startCacheServer(addr string, addrs []string, group *toyCache.Group) {
 	log.Fatal(http.ListenAndServe(addr[7:], peers))
 }
 
+func startGRPCCacheServer(addr string, addrs []string, group *toyCache.Group) {
+	peers := toyCache.NewGRPCPool(addr)
+	peers.Set(addrs...)
+
+	group.RegisterPeer(peers)
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := grpc.NewServer()
+	pb.RegisterGroupCacheServer(server, peers.Server())
+	log.Println("toyCache is running at", addr, "over gRPC")
+	log.Fatal(server.Serve(lis))
+}
+
 func startAPIServer(apiAddr string, group *toyCache.Group) {
 	http.Handle("/api", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		key := r.URL.Query().Get("key")
-		view, err := group.Get(key)
+		var view []byte
+		err := group.Get(r.Context(), key, toyCache.AllocatingByteSliceSink(&view))
+		if errors.Is(err, toyCache.ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		w.Header().Set("Content-Type", "application/octet-stream")
-		_, err = w.Write(view.ByteSlice())
+		_, err = w.Write(view)
 		if err != nil {
 			return
 		}
@@ -55,8 +81,10 @@ func startAPIServer(apiAddr string, group *toyCache.Group) {
 func main() {
 	var port int
 	var api bool
+	var transport string
 	flag.IntVar(&port, "port", 8001, "toyCache server port")
 	flag.BoolVar(&api, "api", false, "start a api server?")
+	flag.StringVar(&transport, "transport", "http", "transport between peers, http or grpc")
 	flag.Parse()
 
 	apiAddr := "http://localhost:9999"
@@ -74,5 +102,13 @@ func main() {
 	if api {
 		go startAPIServer(apiAddr, group)
 	}
+	if transport == "grpc" {
+		// gRPC peers are addressed by host:port
+		for i, v := range addrs {
+			addrs[i] = v[7:]
+		}
+		startGRPCCacheServer(addrMap[port][7:], addrs, group)
+		return
+	}
 	startCacheServer(addrMap[port], addrs, group)
 }
@@ -0,0 +1,245 @@
+package arc
+
+import (
+	"container/list"
+	"github.com/toyCache/toyCache/policy"
+	"time"
+)
+
+// Cache is an Adaptive Replacement Cache. Entries seen once recently live
+// in t1 and entries seen at least twice in t2, the keys recently evicted
+// from each are remembered in b1 and b2 to adapt the target size of t1.
+// Sizes are counted in bytes. It is not safe for concurrent access
+type Cache struct {
+	maxBytes int64
+	p        int64 // target bytes of t1
+	t1, t2   queue // resident entries
+	b1, b2   queue // ghost entries, keys evicted from t1 and t2
+	cache    map[string]*entry
+	expiries policy.Expiries
+	// optional and executed when an entry is purged
+	OnEvicted func(key string, value Value)
+}
+
+type entry struct {
+	key   string
+	value Value // nil for ghost entries
+	size  int64
+	in    *queue
+	ele   *list.Element
+}
+
+// queue is a list of entries, most recent at front
+type queue struct {
+	ll    list.List
+	bytes int64
+}
+
+// Value used Len() to get how many bytes is takes
+type Value = policy.Value
+
+// New is the constructor of Cache
+func New(maxBytes int64, onEvicted func(key string, value Value)) *Cache {
+	return &Cache{
+		maxBytes:  maxBytes,
+		cache:     make(map[string]*entry),
+		OnEvicted: onEvicted,
+	}
+}
+
+// Add adds a value to the cache
+func (c *Cache) Add(key string, value Value) {
+	c.AddWithExpire(key, value, time.Time{})
+}
+
+// AddWithExpire adds a value to the cache which will be treated as
+// missing after expire, a zero expire means the value never expire
+func (c *Cache) AddWithExpire(key string, value Value, expire time.Time) {
+	c.RemoveExpired()
+	size := int64(value.Len()) + int64(len(key))
+	e, ok := c.cache[key]
+	switch {
+	case ok && e.value != nil:
+		e.in.bytes += size - e.size
+		e.size, e.value = size, value
+		c.move(e, &c.t2)
+	case ok:
+		// a ghost hit tells which of recency or frequency should grow
+		inB2 := e.in == &c.b2
+		if inB2 {
+			c.p = max(c.p-ratio(c.b1.bytes, c.b2.bytes)*size, 0)
+		} else {
+			c.p = min(c.p+ratio(c.b2.bytes, c.b1.bytes)*size, c.maxBytes)
+		}
+		c.unlink(e)
+		c.makeRoom(size, inB2)
+		e.size, e.value = size, value
+		c.push(e, &c.t2)
+	default:
+		c.makeRoom(size, false)
+		e = &entry{key: key, value: value, size: size}
+		c.cache[key] = e
+		c.push(e, &c.t1)
+	}
+	c.expiries.Set(key, expire)
+	c.makeRoom(0, false)
+	c.trimGhosts()
+}
+
+// Get look ups a key's value
+func (c *Cache) Get(key string) (value Value, ok bool) {
+	e, ok := c.cache[key]
+	if !ok || e.value == nil {
+		return nil, false
+	}
+	if c.expiries.Expired(key, time.Now()) {
+		c.removeEntry(e)
+		return nil, false
+	}
+	c.move(e, &c.t2)
+	return e.value, true
+}
+
+// Remove removes the provided key from the cache
+func (c *Cache) Remove(key string) {
+	if e, ok := c.cache[key]; ok {
+		if e.value == nil {
+			c.unlink(e)
+			delete(c.cache, key)
+			return
+		}
+		c.removeEntry(e)
+	}
+}
+
+// RemoveExpired remove all items whose deadline has passed
+func (c *Cache) RemoveExpired() {
+	now := time.Now()
+	for key, ok := c.expiries.Next(now); ok; key, ok = c.expiries.Next(now) {
+		c.Remove(key)
+	}
+}
+
+// Deadline return the deadline of key, zero if it has none
+func (c *Cache) Deadline(key string) time.Time {
+	return c.expiries.Deadline(key)
+}
+
+// Walk calls fn for every resident entry, the ones seen once first,
+// each from the least to the most recently used
+func (c *Cache) Walk(fn func(key string, value Value, expire time.Time)) {
+	for _, q := range []*queue{&c.t1, &c.t2} {
+		for ele := q.ll.Back(); ele != nil; ele = ele.Prev() {
+			e := ele.Value.(*entry)
+			fn(e.key, e.value, c.expiries.Deadline(e.key))
+		}
+	}
+}
+
+// Len return the number of cache entries
+func (c *Cache) Len() int {
+	return c.t1.ll.Len() + c.t2.ll.Len()
+}
+
+// Bytes return the number of bytes taken by keys and values
+func (c *Cache) Bytes() int64 {
+	return c.t1.bytes + c.t2.bytes
+}
+
+// makeRoom evicts entries until size more bytes fit in the cache
+func (c *Cache) makeRoom(size int64, inB2 bool) {
+	for c.maxBytes != 0 && c.Len() > 0 && c.maxBytes < c.Bytes()+size {
+		c.replace(inB2)
+	}
+}
+
+// replace evicts the least recent entry of t1 or t2 into its ghost list,
+// t1 gives way when it is above its target size p
+func (c *Cache) replace(inB2 bool) {
+	if c.t1.ll.Len() > 0 && (c.t1.bytes > c.p || (inB2 && c.t1.bytes == c.p) || c.t2.ll.Len() == 0) {
+		c.evict(c.t1.ll.Back().Value.(*entry), &c.b1)
+	} else {
+		c.evict(c.t2.ll.Back().Value.(*entry), &c.b2)
+	}
+}
+
+// trimGhosts bounds the keys remembered in b1 and b2
+func (c *Cache) trimGhosts() {
+	if c.maxBytes == 0 {
+		return
+	}
+	for c.b1.ll.Len() > 0 && c.t1.bytes+c.b1.bytes > c.maxBytes {
+		c.dropGhost(&c.b1)
+	}
+	for c.b2.ll.Len() > 0 && c.Bytes()+c.b1.bytes+c.b2.bytes > 2*c.maxBytes {
+		c.dropGhost(&c.b2)
+	}
+}
+
+func (c *Cache) dropGhost(q *queue) {
+	e := q.ll.Back().Value.(*entry)
+	c.unlink(e)
+	delete(c.cache, e.key)
+}
+
+// evict drops the value of e and remember its key in ghost
+func (c *Cache) evict(e *entry, ghost *queue) {
+	key, value := e.key, e.value
+	c.unlink(e)
+	c.expiries.Delete(key)
+	e.value = nil
+	c.push(e, ghost)
+	if c.OnEvicted != nil {
+		c.OnEvicted(key, value)
+	}
+}
+
+func (c *Cache) removeEntry(e *entry) {
+	c.unlink(e)
+	delete(c.cache, e.key)
+	c.expiries.Delete(e.key)
+	if c.OnEvicted != nil {
+		c.OnEvicted(e.key, e.value)
+	}
+}
+
+func (c *Cache) push(e *entry, q *queue) {
+	e.in = q
+	e.ele = q.ll.PushFront(e)
+	q.bytes += e.size
+}
+
+func (c *Cache) unlink(e *entry) {
+	e.in.ll.Remove(e.ele)
+	e.in.bytes -= e.size
+	e.in, e.ele = nil, nil
+}
+
+func (c *Cache) move(e *entry, q *queue) {
+	c.unlink(e)
+	c.push(e, q)
+}
+
+// ratio return a/b but at least 1
+func ratio(a, b int64) int64 {
+	if b == 0 || a < b {
+		return 1
+	}
+	return a / b
+}
+
+func min(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+var _ policy.Policy = (*Cache)(nil)
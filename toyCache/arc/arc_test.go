@@ -0,0 +1,120 @@
+package arc
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type String string
+
+func (d String) Len() int {
+	return len(d)
+}
+
+func TestCache_Get(t *testing.T) {
+	arc := New(int64(0), nil)
+	arc.Add("key1", String("123"))
+	if v, ok := arc.Get("key1"); !ok || v.Len() != 3 {
+		t.Fatalf("cache hit key1=123 failed")
+	}
+	if _, ok := arc.Get("key2"); ok {
+		t.Fatalf("cache miss key2 failed")
+	}
+}
+
+func TestCache_Add(t *testing.T) {
+	arc := New(int64(0), nil)
+	arc.Add("key", String("123"))
+	arc.Add("key", String("1234"))
+	if arc.Bytes() != int64(len("key")+len("1234")) {
+		t.Fatal("expected 7 but got", arc.Bytes())
+	}
+}
+
+func TestCache_Remove(t *testing.T) {
+	arc := New(int64(0), nil)
+	arc.Add("key1", String("123"))
+	arc.Add("key2", String("456"))
+	arc.Get("key2")
+	arc.Remove("key1")
+	arc.Remove("key2")
+	if arc.Len() != 0 || arc.Bytes() != 0 {
+		t.Fatalf("remove all keys failed")
+	}
+}
+
+func TestCache_OnEvicted(t *testing.T) {
+	keys := make([]string, 0)
+	OnEvicted := func(key string, value Value) {
+		keys = append(keys, key)
+	}
+	arc := New(int64(10), OnEvicted)
+
+	arc.Add("key1", String("12345"))
+	arc.Add("key2", String("12345"))
+	arc.Add("key3", String("12345"))
+	expect := []string{"key1", "key2"}
+
+	if !reflect.DeepEqual(keys, expect) {
+		t.Fatalf("Called OnEvicted failed, expect keys %s, but got %s", expect, keys)
+	}
+}
+
+func TestCache_ScanResistance(t *testing.T) {
+	// room for 10 entries of 10 bytes
+	arc := New(int64(100), nil)
+	hot := make([]string, 5)
+	for i := range hot {
+		hot[i] = fmt.Sprintf("hot%d", i)
+		arc.Add(hot[i], String("123456"))
+		arc.Get(hot[i])
+	}
+	// a scan of keys used once should not flush the hot ones
+	for i := 0; i < 100; i++ {
+		arc.Add(fmt.Sprintf("scan%02d", i), String("1234"))
+	}
+	for _, key := range hot {
+		if _, ok := arc.Get(key); !ok {
+			t.Fatalf("hot key %s was flushed by a scan", key)
+		}
+	}
+	if arc.Bytes() > 100 {
+		t.Fatalf("expected at most 100 bytes but got %d", arc.Bytes())
+	}
+}
+
+func TestCache_GhostHit(t *testing.T) {
+	arc := New(int64(20), nil)
+	arc.Add("key1", String("12345"))
+	arc.Get("key1")
+	arc.Add("key2", String("12345"))
+	arc.Add("key3", String("12345"))
+	if _, ok := arc.Get("key2"); ok {
+		t.Fatalf("key2 should be evicted")
+	}
+	// key2 is remembered in b1, adding it again grows the target of t1
+	arc.Add("key2", String("12345"))
+	if arc.p == 0 {
+		t.Fatalf("ghost hit in b1 should grow p")
+	}
+	if _, ok := arc.Get("key2"); !ok || arc.Len() != 2 {
+		t.Fatalf("key2 should be back in the cache")
+	}
+}
+
+func TestCache_Expire(t *testing.T) {
+	arc := New(int64(0), nil)
+	arc.AddWithExpire("key1", String("123"), time.Now().Add(10*time.Millisecond))
+	arc.Add("key2", String("456"))
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := arc.Get("key1"); ok {
+		t.Fatalf("expired key1 should be a miss")
+	}
+	arc.AddWithExpire("key3", String("789"), time.Now().Add(-time.Millisecond))
+	arc.RemoveExpired()
+	if _, ok := arc.Get("key2"); !ok || arc.Len() != 1 {
+		t.Fatalf("key2 without deadline should not expire")
+	}
+}
@@ -1,34 +1,473 @@
 package toyCache
 
 import (
+	"github.com/toyCache/toyCache/arc"
+	"github.com/toyCache/toyCache/disk"
+	"github.com/toyCache/toyCache/lfu"
 	"github.com/toyCache/toyCache/lru"
+	"github.com/toyCache/toyCache/policy"
+	"github.com/toyCache/toyCache/tinylfu"
+	"log"
 	"sync"
+	"time"
 )
 
 type cache struct {
 	mu         	sync.Mutex
-	lru        	*lru.Cache
+	store      	policy.Policy
+	policy     	EvictionPolicy // nil means LRU
 	cacheBytes 	int64
+	nhit, nget 	int64
+	nevict     	int64 // number of evictions
+
+	// l2 receives the entries evicted from store, nil without a disk tier
+	l2       *disk.Store
+	removing bool  // set while an entry is removed on purpose
+	ndisk    int64 // number of hits served from l2
+	nremove  int64 // number of removals, a promotion racing one is dropped
+
+	// demoted holds the entries evicted under mu until they are written
+	// to l2. The l2 operations run without mu, in the order of tickets
+	// taken under mu, so a slow disk never blocks the memory hits
+	demoted []snapshotEntry
+	l2Next  uint64
+	l2Turn  uint64
+	l2Mu    sync.Mutex
+	l2Cond  *sync.Cond
+
+	// retain receives the entries expired or evicted from store,
+	// nil unless the group serves stale values
+	retain func(key string, value ByteView)
+}
+
+// tieredValue is stored instead of the ByteView when the cache has a
+// disk tier, so an evicted entry is demoted along with its deadline, or
+// when the value has a soft deadline
+type tieredValue struct {
+	ByteView
+	expire time.Time
+	soft   time.Time // when the value goes stale, see WithSoftTTL
+}
+
+func viewOf(v policy.Value) ByteView {
+	if tv, ok := v.(tieredValue); ok {
+		return tv.ByteView
+	}
+	return v.(ByteView)
+}
+
+// EvictionPolicy create the store of a cache bounded by maxBytes,
+// onEvicted must be called for every entry purged from it
+type EvictionPolicy func(maxBytes int64, onEvicted func(key string, value policy.Value)) policy.Policy
+
+// Eviction policies a Group can use, see WithEvictionPolicy
+var (
+	// LRU evicts the least recently used entry
+	LRU EvictionPolicy = func(maxBytes int64, onEvicted func(string, policy.Value)) policy.Policy {
+		return lru.New(maxBytes, onEvicted)
+	}
+	// LFU evicts the least frequently used entry
+	LFU EvictionPolicy = func(maxBytes int64, onEvicted func(string, policy.Value)) policy.Policy {
+		return lfu.New(maxBytes, onEvicted)
+	}
+	// ARC balances between recently and frequently used entries
+	ARC EvictionPolicy = func(maxBytes int64, onEvicted func(string, policy.Value)) policy.Policy {
+		return arc.New(maxBytes, onEvicted)
+	}
+	// TinyLFU only admits entries used more often than the ones they
+	// would evict, which protects the hot set from scans
+	TinyLFU EvictionPolicy = func(maxBytes int64, onEvicted func(string, policy.Value)) policy.Policy {
+		return tinylfu.New(maxBytes, onEvicted)
+	}
+)
+
+// CacheStats are returned by stats accessors on Group
+type CacheStats struct {
+	Bytes     int64
+	Items     int64
+	Gets      int64
+	Hits      int64
+	Evictions int64
+	DiskHits  int64 // hits served from the disk tier
+	DiskBytes int64 // bytes of the disk tier files
+	DiskItems int64
+}
+
+// add stores value under key, a zero expire means the value never expire
+// and a zero soft that it never goes stale
+func (c *cache) add(key string, value ByteView, expire, soft time.Time) {
+	c.mu.Lock()
+	c.addLocked(key, value, expire, soft)
+	if c.l2 == nil {
+		c.mu.Unlock()
+		return
+	}
+	demoted, ticket := c.demotedLocked()
+	c.mu.Unlock()
+	c.l2Do(ticket, func(l2 *disk.Store) {
+		// the copy on disk is stale now
+		if err := l2.Remove(key); err != nil {
+			log.Println("[toyCache] Failed to remove from disk", err)
+		}
+		demote(l2, demoted)
+	})
+}
+
+func (c *cache) addLocked(key string, value ByteView, expire, soft time.Time) {
+	if c.store == nil {
+		newStore := c.policy
+		if newStore == nil {
+			newStore = LRU
+		}
+		c.store = newStore(c.cacheBytes, c.onEvicted)
+	}
+	// the deadline is kept in the value too, it tells an expiry
+	// from an eviction in onEvicted
+	if c.l2 != nil || !expire.IsZero() || !soft.IsZero() {
+		c.store.AddWithExpire(key, tieredValue{ByteView: value, expire: expire, soft: soft}, expire)
+		return
+	}
+	c.store.AddWithExpire(key, value, expire)
+}
+
+// onEvicted queues the entries evicted for room for l2, only them
+// count as evictions
+func (c *cache) onEvicted(key string, value policy.Value) {
+	if c.removing {
+		return
+	}
+	if c.retain != nil {
+		c.retain(key, viewOf(value))
+	}
+	tv, ok := value.(tieredValue)
+	if ok && !tv.expire.IsZero() && !time.Now().Before(tv.expire) {
+		return
+	}
+	c.nevict++
+	if c.l2 == nil || !ok {
+		return
+	}
+	c.demoted = append(c.demoted, snapshotEntry{key: key, value: tv.ByteView, expire: tv.expire})
 }
 
-func (c *cache) add(key string, value ByteView) {
+// demotedLocked take the queued demotions along with the ticket
+// to write them, c.mu must be held
+func (c *cache) demotedLocked() ([]snapshotEntry, uint64) {
+	demoted := c.demoted
+	c.demoted = nil
+	if c.l2Cond == nil {
+		c.l2Cond = sync.NewCond(&c.l2Mu)
+	}
+	ticket := c.l2Next
+	c.l2Next++
+	return demoted, ticket
+}
+
+// l2Do wait for the turn of ticket and run fn, fn is skipped when
+// the disk tier was closed meanwhile
+func (c *cache) l2Do(ticket uint64, fn func(l2 *disk.Store)) {
+	c.l2Mu.Lock()
+	for c.l2Turn != ticket {
+		c.l2Cond.Wait()
+	}
+	l2 := c.l2Store()
+	c.l2Mu.Unlock()
+	if l2 != nil {
+		fn(l2)
+	}
+	c.l2Mu.Lock()
+	c.l2Turn++
+	c.l2Cond.Broadcast()
+	c.l2Mu.Unlock()
+}
+
+func (c *cache) l2Store() *disk.Store {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.lru == nil {
-		c.lru = lru.New(c.cacheBytes, nil)
+	return c.l2
+}
+
+func demote(l2 *disk.Store, demoted []snapshotEntry) {
+	for _, e := range demoted {
+		if err := l2.Put(e.key, e.value.b, e.expire); err != nil {
+			log.Println("[toyCache] Failed to demote to disk", err)
+		}
 	}
-	c.lru.Add(key, value)
+}
+
+// closeDiskTier detach l2 from the cache once the l2 operations
+// in flight are done
+func (c *cache) closeDiskTier() {
+	c.mu.Lock()
+	if c.l2 == nil {
+		c.mu.Unlock()
+		return
+	}
+	demoted, ticket := c.demotedLocked()
+	c.mu.Unlock()
+	c.l2Do(ticket, func(l2 *disk.Store) {
+		demote(l2, demoted)
+		c.mu.Lock()
+		c.l2 = nil
+		c.mu.Unlock()
+	})
 }
 
 func (c *cache) get(key string) (value ByteView, ok bool){
+	value, _, _, ok = c.lookup(key)
+	return
+}
+
+// lookup is get that also return the deadline and the soft deadline
+// of the value
+func (c *cache) lookup(key string) (value ByteView, expire, soft time.Time, ok bool) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.lru == nil {
+	c.nget++
+	if c.store != nil {
+		c.store.RemoveExpired()
+		if v, ok := c.store.Get(key); ok {
+			c.nhit++
+			expire := c.store.Deadline(key)
+			c.mu.Unlock()
+			if tv, ok := v.(tieredValue); ok {
+				soft = tv.soft
+			}
+			return viewOf(v), expire, soft, ok
+		}
+	}
+	if c.l2 == nil {
+		c.mu.Unlock()
 		return
 	}
-	if v, ok := c.lru.Get(key); ok {
-		return v.(ByteView), ok
+	nremove := c.nremove
+	demoted, ticket := c.demotedLocked()
+	c.mu.Unlock()
+
+	var b []byte
+	c.l2Do(ticket, func(l2 *disk.Store) {
+		demote(l2, demoted)
+		var err error
+		b, expire, ok, err = l2.Get(key)
+		if err != nil {
+			log.Println("[toyCache] Failed to get from disk", err)
+		}
+		if ok {
+			l2.Remove(key)
+		}
+	})
+	if !ok {
+		return
 	}
-	return
+	// promote the entry, it is demoted again when evicted. A value
+	// added or removed while l2 was read is newer, keep it
+	value = ByteView{b: b}
+	c.mu.Lock()
+	c.nhit++
+	c.ndisk++
+	newer := c.nremove != nremove
+	if c.store != nil && !newer {
+		_, newer = c.store.Get(key)
+	}
+	if newer || c.l2 == nil {
+		c.mu.Unlock()
+		return value, expire, soft, true
+	}
+	// the soft deadline is not kept on disk
+	c.addLocked(key, value, expire, soft)
+	demoted, ticket = c.demotedLocked()
+	c.mu.Unlock()
+	c.l2Do(ticket, func(l2 *disk.Store) {
+		demote(l2, demoted)
+	})
+	return value, expire, soft, true
+}
+
+func (c *cache) remove(key string) {
+	c.mu.Lock()
+	if c.store != nil {
+		c.removing = true
+		c.store.Remove(key)
+		c.removing = false
+	}
+	c.nremove++
+	if c.l2 == nil {
+		c.mu.Unlock()
+		return
+	}
+	demoted, ticket := c.demotedLocked()
+	c.mu.Unlock()
+	c.l2Do(ticket, func(l2 *disk.Store) {
+		demote(l2, demoted)
+		if err := l2.Remove(key); err != nil {
+			log.Println("[toyCache] Failed to remove from disk", err)
+		}
+	})
+}
+
+// snapshotEntry is an entry of a cache copied out of its store
+type snapshotEntry struct {
+	key    string
+	value  ByteView
+	expire time.Time
+}
+
+// entries return a copy of the entries, least valuable first
+func (c *cache) entries() []snapshotEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store == nil {
+		return nil
+	}
+	list := make([]snapshotEntry, 0, c.store.Len())
+	c.store.Walk(func(key string, value policy.Value, expire time.Time) {
+		list = append(list, snapshotEntry{key: key, value: viewOf(value), expire: expire})
+	})
+	return list
+}
+
+func (c *cache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := CacheStats{
+		Gets:      c.nget,
+		Hits:      c.nhit,
+		Evictions: c.nevict,
+		DiskHits:  c.ndisk,
+	}
+	if c.store != nil {
+		s.Bytes = c.store.Bytes()
+		s.Items = int64(c.store.Len())
+	}
+	return s
+}
+
+// shardedCache splits keys over independently locked caches so that
+// concurrent gets of different keys rarely wait on each other
+type shardedCache struct {
+	shards []cache
+	l2     *disk.Store // shared by the shards, nil without a disk tier
+}
+
+func newShardedCache(n int, cacheBytes int64, policy EvictionPolicy) *shardedCache {
+	if n < 1 {
+		n = 1
+	}
+	c := &shardedCache{shards: make([]cache, n)}
+	for i := range c.shards {
+		// the first shards take the remainder of the division
+		shardBytes := cacheBytes / int64(n)
+		if int64(i) < cacheBytes%int64(n) {
+			shardBytes++
+		}
+		if cacheBytes > 0 && shardBytes < 1 {
+			shardBytes = 1
+		}
+		c.shards[i].cacheBytes = shardBytes
+		c.shards[i].policy = policy
+	}
+	return c
+}
+
+// share return the part 1/ratio of cacheBytes, a bounded cache gets
+// at least 1 byte since 0 means unbounded
+func share(cacheBytes, ratio int64) int64 {
+	if cacheBytes > 0 && cacheBytes < ratio {
+		return 1
+	}
+	return cacheBytes / ratio
+}
+
+// setDiskTier make the shards demote their evicted entries to l2
+func (c *shardedCache) setDiskTier(l2 *disk.Store) {
+	c.l2 = l2
+	for i := range c.shards {
+		c.shards[i].l2 = l2
+	}
+}
+
+// closeDiskTier detach the disk tier from the shards and close it,
+// the cache keeps working in memory only
+func (c *shardedCache) closeDiskTier() error {
+	if c.l2 == nil {
+		return nil
+	}
+	for i := range c.shards {
+		c.shards[i].closeDiskTier()
+	}
+	return c.l2.Close()
+}
+
+// setRetain make the shards pass their expired and evicted entries to retain
+func (c *shardedCache) setRetain(retain func(key string, value ByteView)) {
+	for i := range c.shards {
+		c.shards[i].retain = retain
+	}
+}
+
+func (c *shardedCache) shard(key string) *cache {
+	if len(c.shards) == 1 {
+		return &c.shards[0]
+	}
+	// inlined 32-bit FNV-1a, it does not allocate
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &c.shards[h%uint32(len(c.shards))]
+}
+
+func (c *shardedCache) add(key string, value ByteView, expire, soft time.Time) {
+	c.shard(key).add(key, value, expire, soft)
+}
+
+func (c *shardedCache) get(key string) (value ByteView, ok bool) {
+	return c.shard(key).get(key)
+}
+
+func (c *shardedCache) lookup(key string) (value ByteView, expire, soft time.Time, ok bool) {
+	return c.shard(key).lookup(key)
+}
+
+func (c *shardedCache) remove(key string) {
+	c.shard(key).remove(key)
+}
+
+func (c *shardedCache) entries() []snapshotEntry {
+	var list []snapshotEntry
+	for i := range c.shards {
+		list = append(list, c.shards[i].entries()...)
+	}
+	return list
+}
+
+func (c *shardedCache) stats() CacheStats {
+	var s CacheStats
+	for i := range c.shards {
+		ss := c.shards[i].stats()
+		s.Bytes += ss.Bytes
+		s.Items += ss.Items
+		s.Gets += ss.Gets
+		s.Hits += ss.Hits
+		s.Evictions += ss.Evictions
+		s.DiskHits += ss.DiskHits
+	}
+	if c.l2 != nil {
+		s.DiskBytes = c.l2.Bytes()
+		s.DiskItems = int64(c.l2.Len())
+	}
+	return s
+}
+
+// localCache is implemented by cache and shardedCache
+type localCache interface {
+	add(key string, value ByteView, expire, soft time.Time)
+	get(key string) (value ByteView, ok bool)
+	lookup(key string) (value ByteView, expire, soft time.Time, ok bool)
+	remove(key string)
+	entries() []snapshotEntry
+	stats() CacheStats
 }
 
+var _ localCache = (*cache)(nil)
+var _ localCache = (*shardedCache)(nil)
@@ -2,6 +2,7 @@ package consistenthash
 
 import (
 	"hash/crc32"
+	"math"
 	"sort"
 	"strconv"
 )
@@ -15,6 +16,7 @@ type Map struct {
 	replicas int
 	keys     []int	//be sorted
 	hashMap  map[int]string
+	weights  map[string]int // items and their weight
 }
 
 func New(replicas int, fn Hash) *Map {
@@ -22,6 +24,7 @@ func New(replicas int, fn Hash) *Map {
 		hash: fn,
 		replicas: replicas,
 		hashMap: make(map[int]string),
+		weights: make(map[string]int),
 	}
 	if m.hash == nil {
 		m.hash = crc32.ChecksumIEEE
@@ -37,15 +40,30 @@ func (m *Map) IsEmpty() bool {
 // Add adds some keys to the hash
 func (m *Map) Add(keys  ...string) {
 	for _, key := range keys {
-		for i:= 0; i < m.replicas; i++ {
-			hash := int(m.hash([]byte(strconv.Itoa(i) + key)))
-			m.keys = append(m.keys, hash)
-			m.hashMap[hash] = key
-		}
+		m.add(key, 1)
+	}
+	sort.Ints(m.keys)
+}
+
+// AddWeighted adds a key placed weight times replicas on the hash,
+// so it gets a share of the keys proportional to weight
+func (m *Map) AddWeighted(key string, weight int) {
+	if weight < 1 {
+		weight = 1
 	}
+	m.add(key, weight)
 	sort.Ints(m.keys)
 }
 
+func (m *Map) add(key string, weight int) {
+	for i := 0; i < m.replicas*weight; i++ {
+		hash := int(m.hash([]byte(strconv.Itoa(i) + key)))
+		m.keys = append(m.keys, hash)
+		m.hashMap[hash] = key
+	}
+	m.weights[key] = weight
+}
+
 // Get gets closet item in the hash to the provided key
 func (m *Map) Get(key string) string{
 	if m.IsEmpty() {
@@ -58,4 +76,105 @@ func (m *Map) Get(key string) string{
 		return m.keys[i] >= hash
 	})
 	return m.hashMap[m.keys[idx % len(m.keys)]]
-}
\ No newline at end of file
+}
+
+// GetN gets the n distinct items met first walking the hash from the
+// provided key, the first one is the item Get return
+func (m *Map) GetN(key string, n int) []string {
+	if m.IsEmpty() || n <= 0 {
+		return nil
+	}
+	hash := int(m.hash([]byte(key)))
+	idx := sort.Search(len(m.keys), func(i int) bool {
+		return m.keys[i] >= hash
+	})
+	items := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; i < len(m.keys) && len(items) < n; i++ {
+		item := m.hashMap[m.keys[(idx+i)%len(m.keys)]]
+		if !seen[item] {
+			seen[item] = true
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// GetBounded gets the closet item in the hash to the provided key whose
+// load stays within (1+epsilon) times its weighted share of the total
+// load once the key is added, items over it are skipped. load return
+// the current load of an item, e.g. its in-flight requests
+func (m *Map) GetBounded(key string, epsilon float64, load func(item string) int64) string {
+	if m.IsEmpty() {
+		return ""
+	}
+	var total int64
+	var totalWeight int
+	for item, weight := range m.weights {
+		total += load(item)
+		totalWeight += weight
+	}
+	hash := int(m.hash([]byte(key)))
+	idx := sort.Search(len(m.keys), func(i int) bool {
+		return m.keys[i] >= hash
+	})
+	first := m.hashMap[m.keys[idx%len(m.keys)]]
+	seen := make(map[string]bool)
+	for i := 0; i < len(m.keys) && len(seen) < len(m.weights); i++ {
+		item := m.hashMap[m.keys[(idx+i)%len(m.keys)]]
+		if seen[item] {
+			continue
+		}
+		seen[item] = true
+		share := float64(total+1) * float64(m.weights[item]) / float64(totalWeight)
+		if float64(load(item)+1) <= math.Ceil((1+epsilon)*share) {
+			return item
+		}
+	}
+	return first
+}
+
+// Remove removes some keys and their replicas from the hash
+func (m *Map) Remove(keys ...string) {
+	removed := false
+	for _, key := range keys {
+		for i := 0; i < m.replicas*m.weights[key]; i++ {
+			hash := int(m.hash([]byte(strconv.Itoa(i) + key)))
+			if m.hashMap[hash] == key {
+				delete(m.hashMap, hash)
+				removed = true
+			}
+		}
+		delete(m.weights, key)
+	}
+	if !removed {
+		return
+	}
+	live := m.keys[:0]
+	for _, hash := range m.keys {
+		if _, ok := m.hashMap[hash]; ok {
+			live = append(live, hash)
+		}
+	}
+	m.keys = live
+}
+
+// Clone return a copy of the hash which can be modified
+// without affecting m
+func (m *Map) Clone() *Map {
+	c := &Map{
+		hash:     m.hash,
+		replicas: m.replicas,
+		keys:     make([]int, len(m.keys)),
+		hashMap:  make(map[int]string, len(m.hashMap)),
+		weights:  make(map[string]int, len(m.weights)),
+	}
+	copy(c.keys, m.keys)
+	for hash, key := range m.hashMap {
+		c.hashMap[hash] = key
+	}
+	for key, weight := range m.weights {
+		c.weights[key] = weight
+	}
+	return c
+}
@@ -2,6 +2,7 @@ package consistenthash
 
 import (
 	"github.com/stretchr/testify/require"
+	"math"
 	"strconv"
 	"testing"
 )
@@ -55,3 +56,128 @@ func TestConsistency(t *testing.T) {
 	}
 
 }
+
+func TestRemove(t *testing.T) {
+	hash := New(3, func(data []byte) uint32 {
+		i, err := strconv.Atoi(string(data))
+		if err != nil {
+			panic(err)
+		}
+		return uint32(i)
+	})
+	// 2, 4, 6, 8, 12, 14, 16, 18, 22, 24, 26, 28
+	hash.Add("2", "4", "6", "8")
+	clone := hash.Clone()
+	hash.Remove("8")
+
+	testCase := map[string]string{
+		"2":  "2",
+		"3":  "4",
+		"17": "2",
+		"27": "2",
+	}
+	for k, v := range testCase {
+		require.Equal(t, v, hash.Get(k))
+	}
+	require.Equal(t, "8", clone.Get("17"), "clone should not be affected by Remove")
+
+	hash.Remove("2", "4", "6")
+	require.True(t, hash.IsEmpty())
+	require.Equal(t, "", hash.Get("17"))
+}
+
+func TestRemoveMovesOnlyRemovedKeys(t *testing.T) {
+	hash := New(50, nil)
+	hash.Add("a", "b", "c", "d")
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		k := strconv.Itoa(i)
+		before[k] = hash.Get(k)
+	}
+	hash.Remove("c")
+	for k, owner := range before {
+		if owner != "c" {
+			require.Equal(t, owner, hash.Get(k), "key %s should not move", k)
+		} else {
+			require.NotEqual(t, "c", hash.Get(k))
+		}
+	}
+}
+
+func TestGetN(t *testing.T) {
+	hash := New(3, func(data []byte) uint32 {
+		i, err := strconv.Atoi(string(data))
+		if err != nil {
+			panic(err)
+		}
+		return uint32(i)
+	})
+	// 2, 4, 6, 12, 14, 16, 22, 24, 26
+	hash.Add("2", "4", "6")
+
+	require.Equal(t, []string{"4", "6"}, hash.GetN("3", 2))
+	require.Equal(t, []string{"2", "4", "6"}, hash.GetN("27", 5), "there are only 3 distinct items")
+	require.Equal(t, hash.Get("15"), hash.GetN("15", 1)[0])
+	require.Empty(t, New(3, nil).GetN("15", 2))
+}
+
+func TestWeightedDistribution(t *testing.T) {
+	hash := New(100, nil)
+	hash.AddWeighted("small", 1)
+	hash.AddWeighted("large", 3)
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[hash.Get(strconv.Itoa(i))]++
+	}
+	share := float64(counts["large"]) / 10000
+	require.InDelta(t, 0.75, share, 0.1, "large should own about 3/4 of the keys")
+
+	hash.Remove("large")
+	require.Equal(t, "small", hash.Get("42"))
+	require.Len(t, hash.keys, 100, "every virtual node of large should be removed")
+}
+
+func TestWeightedAddMovesOnlyToNewItem(t *testing.T) {
+	hash := New(50, nil)
+	hash.AddWeighted("a", 1)
+	hash.AddWeighted("b", 2)
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		k := strconv.Itoa(i)
+		before[k] = hash.Get(k)
+	}
+	after := hash.Clone()
+	after.AddWeighted("c", 2)
+	moved := 0
+	for k, owner := range before {
+		if now := after.Get(k); now != owner {
+			require.Equal(t, "c", now, "key %s should only move to the new item", k)
+			moved++
+		}
+	}
+	require.InDelta(t, 400, moved, 100, "c should take about 2/5 of the keys")
+	require.Equal(t, before["7"], hash.Get("7"), "clone should not affect the original")
+}
+
+func TestGetBounded(t *testing.T) {
+	hash := New(50, nil)
+	hash.Add("a", "b", "c", "d")
+	loads := make(map[string]int64)
+	load := func(item string) int64 { return loads[item] }
+
+	for i := 0; i < 100; i++ {
+		k := strconv.Itoa(i)
+		require.Equal(t, hash.Get(k), hash.GetBounded(k, 0.25, func(string) int64 { return 0 }),
+			"without load GetBounded should match Get")
+	}
+
+	// every key is heavy and stays in flight
+	const keys, epsilon = 1000, 0.25
+	for i := 0; i < keys; i++ {
+		loads[hash.GetBounded(strconv.Itoa(i%7), epsilon, load)]++
+	}
+	bound := int64(math.Ceil((1 + epsilon) * keys / 4))
+	for item, n := range loads {
+		require.LessOrEqual(t, n, bound, "%s is over the load bound", item)
+	}
+}
@@ -0,0 +1,409 @@
+// Package disk implements an on-disk store for the entries evicted from
+// memory. Entries are appended to a log split into segment files, an
+// in-memory index points to the latest record of each key. The oldest
+// segment is compacted when mostly dead and dropped when over budget
+package disk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// a record is crc32c | flags | uint32 len(key) | uint32 len(value) |
+	// int64 expire | key | value, the crc covers everything after itself
+	headerSize = 4 + 1 + 4 + 4 + 8
+
+	flagTombstone = 1
+
+	// segmentsPerStore is how many segments the byte budget is split into
+	segmentsPerStore = 8
+	segmentExt       = ".seg"
+
+	// defaultSegmentBytes is the segment size of an unbounded store
+	defaultSegmentBytes = 64 << 20
+	// minSegmentBytes keeps a few small records per segment in a
+	// store with a tiny budget
+	minSegmentBytes = 256
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorrupted is returned when a record fails its checksum
+var ErrCorrupted = errors.New("disk: corrupted record")
+
+// Store is a log structured store bounded in bytes,
+// it is safe for concurrent access
+type Store struct {
+	mu           sync.Mutex
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+	segments     []*segment // oldest first, the last one is appended to
+	index        map[string]*location
+	nextID       int
+	size         int64 // bytes of all segment files
+}
+
+type segment struct {
+	id   int
+	f    *os.File
+	size int64
+	live int64 // bytes of the records still in index
+}
+
+type location struct {
+	seg    *segment
+	off    int64
+	size   int64
+	expire time.Time
+}
+
+// Open the store kept in dir, the index is rebuilt from the segments
+// found there. maxBytes bounds the size of the segment files, zero
+// means unbounded
+func Open(dir string, maxBytes int64) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if maxBytes < 0 {
+		maxBytes = 0
+	}
+	segmentBytes := maxBytes / segmentsPerStore
+	if maxBytes == 0 {
+		// without a budget the segments are never dropped, keep them few
+		segmentBytes = defaultSegmentBytes
+	} else if segmentBytes < minSegmentBytes {
+		segmentBytes = minSegmentBytes
+	}
+	s := &Store{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: segmentBytes,
+		index:        make(map[string]*location),
+	}
+	ids, err := s.segmentIDs()
+	if err != nil {
+		return nil, err
+	}
+	for i, id := range ids {
+		seg, err := s.openSegment(id)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.segments = append(s.segments, seg)
+		if err := s.recover(seg, i == len(ids)-1); err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.nextID = id + 1
+	}
+	if len(s.segments) == 0 {
+		if err := s.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Put stores value under key, a zero expire means the value never expire
+func (s *Store) Put(key string, value []byte, expire time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := encode(0, key, value, expire)
+	if err := s.makeRoom(int64(len(rec))); err != nil {
+		return err
+	}
+	if err := s.append(key, rec, expire); err != nil {
+		return err
+	}
+	return s.evict()
+}
+
+// Get look ups a key's value, expired values are misses
+func (s *Store) Get(key string) (value []byte, expire time.Time, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	loc, ok := s.index[key]
+	if !ok {
+		return nil, time.Time{}, false, nil
+	}
+	if !loc.expire.IsZero() && !time.Now().Before(loc.expire) {
+		s.forget(key, loc)
+		return nil, time.Time{}, false, nil
+	}
+	_, _, value, _, err = s.read(loc)
+	if err != nil {
+		s.forget(key, loc)
+		return nil, time.Time{}, false, err
+	}
+	return value, loc.expire, true, nil
+}
+
+// Remove removes the provided key, a tombstone is written so that
+// the key is not recovered when the store is opened again
+func (s *Store) Remove(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	loc, ok := s.index[key]
+	if !ok {
+		return nil
+	}
+	s.forget(key, loc)
+	rec := encode(flagTombstone, key, nil, time.Time{})
+	if err := s.makeRoom(int64(len(rec))); err != nil {
+		return err
+	}
+	active := s.active()
+	if _, err := active.f.WriteAt(rec, active.size); err != nil {
+		return err
+	}
+	active.size += int64(len(rec))
+	s.size += int64(len(rec))
+	return s.evict()
+}
+
+// Len return the number of entries
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.index)
+}
+
+// Bytes return the size of the segment files
+func (s *Store) Bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Close closes the segment files, the store must not be used after
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var first error
+	for _, seg := range s.segments {
+		if err := seg.f.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	s.segments = nil
+	return first
+}
+
+func (s *Store) active() *segment {
+	return s.segments[len(s.segments)-1]
+}
+
+// append write rec to the active segment and point key to it
+func (s *Store) append(key string, rec []byte, expire time.Time) error {
+	active := s.active()
+	if _, err := active.f.WriteAt(rec, active.size); err != nil {
+		return err
+	}
+	if old, ok := s.index[key]; ok {
+		s.forget(key, old)
+	}
+	s.index[key] = &location{seg: active, off: active.size, size: int64(len(rec)), expire: expire}
+	active.size += int64(len(rec))
+	active.live += int64(len(rec))
+	s.size += int64(len(rec))
+	return nil
+}
+
+// forget drops key from the index, its record becomes dead
+func (s *Store) forget(key string, loc *location) {
+	loc.seg.live -= loc.size
+	delete(s.index, key)
+}
+
+func (s *Store) rotate() error {
+	seg, err := s.openSegment(s.nextID)
+	if err != nil {
+		return err
+	}
+	s.nextID++
+	s.segments = append(s.segments, seg)
+	return nil
+}
+
+// makeRoom rotate to a new segment when n bytes don't fit the active
+// one, the oldest segment is compacted then
+func (s *Store) makeRoom(n int64) error {
+	if active := s.active(); active.size == 0 || active.size+n <= s.segmentBytes {
+		return nil
+	}
+	if err := s.rotate(); err != nil {
+		return err
+	}
+	return s.compact()
+}
+
+// compact rewrite the live records of the oldest segment while it is
+// mostly dead. Only the oldest one is compacted, so the tombstones it
+// drops never shadow records of an older segment
+func (s *Store) compact() error {
+	for len(s.segments) > 1 {
+		oldest := s.segments[0]
+		if oldest.live*2 >= oldest.size {
+			return nil
+		}
+		for key, loc := range s.index {
+			if loc.seg != oldest {
+				continue
+			}
+			flags, _, value, _, err := s.read(loc)
+			if err != nil {
+				s.forget(key, loc)
+				continue
+			}
+			if err := s.append(key, encode(flags, key, value, loc.expire), loc.expire); err != nil {
+				return err
+			}
+		}
+		if err := s.drop(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evict drops the oldest segments while the store is over budget
+func (s *Store) evict() error {
+	for s.maxBytes > 0 && s.size > s.maxBytes && len(s.segments) > 1 {
+		if err := s.drop(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drop removes the oldest segment along with the keys it holds
+func (s *Store) drop() error {
+	oldest := s.segments[0]
+	for key, loc := range s.index {
+		if loc.seg == oldest {
+			s.forget(key, loc)
+		}
+	}
+	s.segments = s.segments[1:]
+	s.size -= oldest.size
+	oldest.f.Close()
+	return os.Remove(oldest.f.Name())
+}
+
+func (s *Store) read(loc *location) (flags byte, key string, value []byte, expire time.Time, err error) {
+	rec := make([]byte, loc.size)
+	if _, err := loc.seg.f.ReadAt(rec, loc.off); err != nil {
+		return 0, "", nil, time.Time{}, err
+	}
+	flags, key, value, expire, _, err = decode(rec)
+	return
+}
+
+// recover index the records of seg, a torn write at the end of the
+// last segment is truncated
+func (s *Store) recover(seg *segment, last bool) error {
+	data, err := io.ReadAll(seg.f)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var off int64
+	for off < int64(len(data)) {
+		flags, key, _, expire, n, err := decode(data[off:])
+		if err != nil {
+			break
+		}
+		if old, ok := s.index[key]; ok {
+			s.forget(key, old)
+		}
+		if flags&flagTombstone == 0 && (expire.IsZero() || now.Before(expire)) {
+			s.index[key] = &location{seg: seg, off: off, size: int64(n), expire: expire}
+			seg.live += int64(n)
+		}
+		off += int64(n)
+	}
+	if off < int64(len(data)) && last {
+		if err := seg.f.Truncate(off); err != nil {
+			return err
+		}
+		data = data[:off]
+	}
+	seg.size = int64(len(data))
+	s.size += seg.size
+	return nil
+}
+
+func (s *Store) segmentIDs() ([]int, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, name := range names {
+		var id int
+		base := strings.TrimSuffix(filepath.Base(name), segmentExt)
+		if _, err := fmt.Sscanf(base, "%d", &id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (s *Store) openSegment(id int) (*segment, error) {
+	name := filepath.Join(s.dir, fmt.Sprintf("%08d%s", id, segmentExt))
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &segment{id: id, f: f}, nil
+}
+
+func encode(flags byte, key string, value []byte, expire time.Time) []byte {
+	rec := make([]byte, headerSize+len(key)+len(value))
+	rec[4] = flags
+	binary.LittleEndian.PutUint32(rec[5:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(rec[9:], uint32(len(value)))
+	if !expire.IsZero() {
+		binary.LittleEndian.PutUint64(rec[13:], uint64(expire.UnixNano()))
+	}
+	copy(rec[headerSize:], key)
+	copy(rec[headerSize+len(key):], value)
+	binary.LittleEndian.PutUint32(rec, crc32.Checksum(rec[4:], crcTable))
+	return rec
+}
+
+// decode return the record at the start of b and its size
+func decode(b []byte) (flags byte, key string, value []byte, expire time.Time, n int, err error) {
+	if len(b) < headerSize {
+		return 0, "", nil, time.Time{}, 0, ErrCorrupted
+	}
+	keyLen := int(binary.LittleEndian.Uint32(b[5:]))
+	valueLen := int(binary.LittleEndian.Uint32(b[9:]))
+	n = headerSize + keyLen + valueLen
+	if keyLen < 0 || valueLen < 0 || n > len(b) || n < headerSize {
+		return 0, "", nil, time.Time{}, 0, ErrCorrupted
+	}
+	if crc32.Checksum(b[4:n], crcTable) != binary.LittleEndian.Uint32(b) {
+		return 0, "", nil, time.Time{}, 0, ErrCorrupted
+	}
+	flags = b[4]
+	if nanos := int64(binary.LittleEndian.Uint64(b[13:])); nanos != 0 {
+		expire = time.Unix(0, nanos)
+	}
+	key = string(b[headerSize : headerSize+keyLen])
+	value = append([]byte(nil), b[headerSize+keyLen:n]...)
+	return flags, key, value, expire, n, nil
+}
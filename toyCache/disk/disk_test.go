@@ -0,0 +1,213 @@
+package disk
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, s *Store, key string) (string, bool) {
+	t.Helper()
+	v, _, ok, err := s.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%s) failed: %v", key, err)
+	}
+	return string(v), ok
+}
+
+func TestStore_PutGet(t *testing.T) {
+	s, err := Open(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Put("key1", []byte("v1"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	s.Put("key1", []byte("v2"), time.Time{})
+	if v, ok := get(t, s, "key1"); !ok || v != "v2" {
+		t.Fatalf("cache hit key1=v2 failed, got %q", v)
+	}
+	if _, ok := get(t, s, "key2"); ok {
+		t.Fatalf("cache miss key2 failed")
+	}
+	if s.Len() != 1 {
+		t.Fatalf("Len is %d, want 1", s.Len())
+	}
+}
+
+func TestStore_Expire(t *testing.T) {
+	s, err := Open(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Put("key1", []byte("v1"), time.Now().Add(-time.Second))
+	if _, ok := get(t, s, "key1"); ok {
+		t.Fatalf("expired key1 should be a miss")
+	}
+}
+
+func TestStore_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put("key1", []byte("v1"), time.Time{})
+	s.Put("key2", []byte("v2"), time.Time{})
+	s.Put("key1", []byte("v3"), time.Time{})
+	s.Remove("key2")
+	s.Close()
+
+	s, err = Open(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, ok := get(t, s, "key1"); !ok || v != "v3" {
+		t.Fatalf("latest key1 should be recovered, got %q", v)
+	}
+	if _, ok := get(t, s, "key2"); ok {
+		t.Fatalf("removed key2 should not be recovered")
+	}
+}
+
+func TestStore_TornWrite(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put("key1", []byte("v1"), time.Time{})
+	s.Put("key2", []byte("v2"), time.Time{})
+	name := s.active().f.Name()
+	size := s.active().size
+	s.Close()
+	if err := os.Truncate(name, size-1); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, ok := get(t, s, "key1"); !ok {
+		t.Fatalf("key1 should survive a torn write of key2")
+	}
+	if _, ok := get(t, s, "key2"); ok {
+		t.Fatalf("torn key2 should be dropped")
+	}
+	if s.Bytes() != size-int64(len(encode(0, "key2", []byte("v2"), time.Time{}))) {
+		t.Fatalf("torn record should be truncated, size is %d", s.Bytes())
+	}
+}
+
+func TestStore_Budget(t *testing.T) {
+	s, err := Open(t.TempDir(), 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	value := make([]byte, 40)
+	for i := 0; i < 200; i++ {
+		s.Put("key"+strconv.Itoa(i), value, time.Time{})
+	}
+	if s.Bytes() > 2048 {
+		t.Fatalf("store takes %d bytes, over its budget", s.Bytes())
+	}
+	if _, ok := get(t, s, "key0"); ok {
+		t.Fatalf("oldest key should be evicted")
+	}
+	if _, ok := get(t, s, "key199"); !ok {
+		t.Fatalf("newest key should be kept")
+	}
+}
+
+func TestStore_RemoveBudget(t *testing.T) {
+	s, err := Open(t.TempDir(), 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	value := make([]byte, 20)
+	for i := 0; i < 30; i++ {
+		s.Put("key"+strconv.Itoa(i), value, time.Time{})
+	}
+	for i := 0; i < 30; i++ {
+		if err := s.Remove("key" + strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.Bytes() > 2048 {
+		t.Fatalf("store takes %d bytes with tombstones, over its budget", s.Bytes())
+	}
+	for _, seg := range s.segments {
+		if seg.size > s.segmentBytes {
+			t.Fatalf("segment %d takes %d bytes, over %d", seg.id, seg.size, s.segmentBytes)
+		}
+	}
+}
+
+func TestStore_TinyBudget(t *testing.T) {
+	s, err := Open(t.TempDir(), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.segmentBytes != minSegmentBytes {
+		t.Fatalf("segment size is %d, want %d", s.segmentBytes, minSegmentBytes)
+	}
+	for i := 0; i < 4; i++ {
+		s.Put("key"+strconv.Itoa(i), []byte("v"), time.Time{})
+	}
+	if len(s.segments) != 1 {
+		t.Fatalf("small records should share a segment, %d segments", len(s.segments))
+	}
+}
+
+func TestStore_Compact(t *testing.T) {
+	s, err := Open(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.segmentBytes = 256
+	value := make([]byte, 40)
+	for i := 0; i < 100; i++ {
+		// rewriting the same keys leaves the old segments dead
+		s.Put("key"+strconv.Itoa(i%4), value, time.Time{})
+	}
+	if len(s.segments) > 3 {
+		t.Fatalf("dead segments should be compacted, %d left", len(s.segments))
+	}
+	for i := 0; i < 4; i++ {
+		if _, ok := get(t, s, "key"+strconv.Itoa(i)); !ok {
+			t.Fatalf("key%d should survive compaction", i)
+		}
+	}
+}
+
+func TestStore_Unbounded(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 100; i++ {
+		s.Put("key"+strconv.Itoa(i), []byte("value"), time.Time{})
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("unbounded store should not rotate on every Put, got %d segments", len(files))
+	}
+	if _, ok := get(t, s, "key0"); !ok {
+		t.Fatalf("unbounded store should keep key0")
+	}
+}
@@ -0,0 +1,80 @@
+package toyCache
+
+import (
+	"context"
+	"errors"
+	pb "github.com/toyCache/toyCache/toycachepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+)
+
+// FallbackPolicy tells a Group who loads a key when its owner fails
+type FallbackPolicy int
+
+const (
+	// FallbackLocal load the key with the local Getter, so every peer
+	// asked for the key while its owner is down loads it
+	FallbackLocal FallbackPolicy = iota
+	// FallbackSuccessor ask the next peer on the ring, so the key is
+	// still loaded by a single peer of the cluster. The local Getter is
+	// the last resort when the successor fails too. It needs a
+	// PeerPicker implementing FallbackPicker
+	FallbackSuccessor
+)
+
+// WithFallback set who loads a key when its owner fails,
+// the default is FallbackLocal
+func WithFallback(p FallbackPolicy) GroupOption {
+	return func(g *Group) {
+		g.fallback = p
+	}
+}
+
+// loadFromFallback ask the successor of owner for key, owner is nil when
+// it was ejected before being asked. ok is false when the key is left
+// to the local Getter
+func (g *Group) loadFromFallback(ctx context.Context, key string, owner PeerGetter) (value ByteView, ok bool, err error) {
+	if g.fallback != FallbackSuccessor || isForwarded(ctx) {
+		return ByteView{}, false, nil
+	}
+	picker, ok := g.peers.(FallbackPicker)
+	if !ok {
+		return ByteView{}, false, nil
+	}
+	peer, ok := picker.PickFallback(key)
+	if !ok || peer == nil || peer == owner {
+		// we are the successor, or no one else is left
+		return ByteView{}, false, nil
+	}
+	req := &pb.Request{Group: g.name, Key: key, Forwarded: true, Fallback: true}
+	value, err = g.requestPeer(ctx, peer, req)
+	if err == nil || errors.Is(err, ErrNotFound) {
+		g.stats.peerLoads.Add(1)
+		g.stats.fallbackLoads.Add(1)
+		if err != nil {
+			g.populateNegative(key, err)
+		}
+		return value, true, err
+	}
+	g.stats.peerErrors.Add(1)
+	log.Println("[toyCache] Failed to get from fallback peer", err)
+	return ByteView{}, false, nil
+}
+
+// ownerUnreachable report whether err means the owner could not be
+// asked at all, as opposed to an answer of the owner such as a load
+// error or a stale value. Only then is the successor asked
+func ownerUnreachable(err error) bool {
+	if errors.Is(err, ErrNotFound) || errors.Is(err, errStale) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if se, ok := err.(*statusError); ok {
+		return isRetryable(se)
+	}
+	if st, ok := status.FromError(err); ok {
+		return st.Code() == codes.Unavailable
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+package toyCache
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	pb "github.com/toyCache/toyCache/toycachepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fallbackPicker struct {
+	owner, fallback PeerGetter
+}
+
+func (p fallbackPicker) PickPeer(key string) (PeerGetter, bool) {
+	return p.owner, p.owner != nil
+}
+
+func (p fallbackPicker) PickFallback(key string) (PeerGetter, bool) {
+	return p.fallback, true
+}
+
+func TestFallbackSuccessor(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		policy        FallbackPolicy
+		successorDown bool
+		want          string
+		loads         int
+	}{
+		{"fallbackLocal", FallbackLocal, false, "Tom", 1},
+		{"fallbackSuccessor", FallbackSuccessor, false, "replica:Tom", 0},
+		{"fallbackLastResort", FallbackSuccessor, true, "Tom", 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			loads := 0
+			toyC := NewGroup(tc.name, 2<<10, GetterFunc(func(key string) ([]byte, error) {
+				loads++
+				return []byte(key), nil
+			}), WithFallback(tc.policy))
+			owner, successor := &replicaPeer{down: true}, &replicaPeer{down: tc.successorDown}
+			toyC.RegisterPeer(fallbackPicker{owner: owner, fallback: successor})
+
+			view, err := getView(toyC, context.Background(), "Tom")
+			require.NoError(t, err)
+			require.Equal(t, tc.want, view.String())
+			require.Equal(t, tc.loads, loads)
+		})
+	}
+}
+
+func TestFallbackEjectedOwner(t *testing.T) {
+	loads := 0
+	toyC := NewGroup("fallbackEjected", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}), WithFallback(FallbackSuccessor))
+	successor := &replicaPeer{}
+	toyC.RegisterPeer(fallbackPicker{fallback: successor})
+
+	view, err := getView(toyC, context.Background(), "Tom")
+	require.NoError(t, err)
+	require.Equal(t, "replica:Tom", view.String(), "successor should take over the keys of an ejected owner")
+	require.Equal(t, 0, loads)
+	require.Equal(t, int64(1), toyC.Stats().FallbackLoads)
+}
+
+func TestHTTPPoolPickFallback(t *testing.T) {
+	pool := NewHTTPPool("http://localhost:8001")
+	pool.Set("http://localhost:8001", "http://localhost:8002", "http://localhost:8003")
+	for _, key := range []string{"Tom", "Bob", "Jack", "Sam", "Ann", "Joe"} {
+		owner, remote := pool.PickPeer(key)
+		fallback, ok := pool.PickFallback(key)
+		if !remote {
+			require.False(t, ok, "%s is owned by the local peer", key)
+			continue
+		}
+		require.True(t, ok)
+		if fallback != nil {
+			require.NotEqual(t, owner, fallback, "fallback of %s should not be its owner", key)
+		}
+	}
+}
+
+func TestHTTPPoolFallbackRequest(t *testing.T) {
+	loads := 0
+	toyC := NewGroup("fallbackRequest", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}))
+	pool := NewHTTPPool("")
+	pool.Set("http://127.0.0.1:1")
+	toyC.RegisterPeer(pool)
+	srv := httptest.NewServer(pool)
+	t.Cleanup(srv.Close)
+
+	res := &pb.Response{}
+	req := &pb.Request{Group: "fallbackRequest", Key: "Tom", Forwarded: true, Fallback: true}
+	require.NoError(t, pool.newGetter(srv.URL).Get(context.Background(), req, res))
+	require.Equal(t, "Tom", string(res.Value))
+	require.Equal(t, 1, loads, "successor should load the key itself")
+	require.Equal(t, int64(0), toyC.Stats().RingDisagreements, "a fallback is not a ring disagreement")
+}
+
+// answeringPeer is a live owner that fails with err
+type answeringPeer struct {
+	testPeer
+	err error
+}
+
+func (p *answeringPeer) Get(_ context.Context, in *pb.Request, out *pb.Response) error {
+	return p.err
+}
+
+func TestFallbackOnlyWhenUnreachable(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		err      error
+		want     string
+		fallback bool
+	}{
+		{"loadError", &statusError{code: http.StatusInternalServerError}, "Tom", false},
+		{"stale", errStale, "Tom", false},
+		{"grpcInternal", status.Error(codes.Internal, "db is down"), "Tom", false},
+		{"unavailable", &statusError{code: http.StatusServiceUnavailable}, "replica:Tom", true},
+		{"grpcUnavailable", status.Error(codes.Unavailable, "connection refused"), "replica:Tom", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			toyC := NewGroup("fallbackOnly"+tc.name, 2<<10, GetterFunc(func(key string) ([]byte, error) {
+				return []byte(key), nil
+			}), WithFallback(FallbackSuccessor))
+			successor := &replicaPeer{}
+			toyC.RegisterPeer(fallbackPicker{owner: &answeringPeer{err: tc.err}, fallback: successor})
+
+			view, err := getView(toyC, context.Background(), "Tom")
+			require.NoError(t, err)
+			require.Equal(t, tc.want, view.String())
+			if tc.fallback {
+				require.Equal(t, 1, successor.gets)
+			} else {
+				require.Equal(t, 0, successor.gets, "an owner that answered should not be replaced")
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package toyCache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/toyCache/toyCache/consistenthash"
+	pb "github.com/toyCache/toyCache/toycachepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// GRPCPool implement a PeerPicker for a pool of gRPC peers,
+// Server return the GroupCache service other peers talk to
+type GRPCPool struct {
+	self     string
+	dialOpts []grpc.DialOption
+	mu       sync.Mutex   // serializes updates of ring
+	ring     atomic.Value // holds *grpcRing, swapped on every update
+}
+
+// grpcRing is an immutable snapshot of the pool' peers
+type grpcRing struct {
+	peers       *consistenthash.Map
+	grpcGetters map[string]*grpcGetter // keyed by e.g. "10.0.0.2:8008"
+	hasSelf     bool                   // self is on peers, it has no getter
+}
+
+// NewGRPCPool initializes a gRPC pool of peers, opts are used when
+// dialing the peers and default to an insecure connection
+func NewGRPCPool(self string, opts ...grpc.DialOption) *GRPCPool {
+	if len(opts) == 0 {
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	p := &GRPCPool{
+		self:     self,
+		dialOpts: opts,
+	}
+	p.ring.Store(&grpcRing{
+		peers:       consistenthash.New(defaultReplicas, nil),
+		grpcGetters: make(map[string]*grpcGetter),
+	})
+	return p
+}
+
+// Log GRPCPool info with peer name
+func (p *GRPCPool) Log(format string, v ...interface{}) {
+	log.Printf("[Server %s] %s", p.self, fmt.Sprintf(format, v...))
+}
+
+// Set update the pool' list of peer, each peer should be an address
+// for example 10.0.0.2:8008. Connections to peers that stay in
+// the pool are kept, the others are closed. Peers that can't be
+// dialed are left out
+func (p *GRPCPool) Set(peers ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old := p.loadRing()
+	r := &grpcRing{
+		peers:       consistenthash.New(defaultReplicas, nil),
+		grpcGetters: make(map[string]*grpcGetter, len(peers)),
+	}
+	p.add(r, old.grpcGetters, peers)
+	p.ring.Store(r)
+	for peer, getter := range old.grpcGetters {
+		if _, ok := r.grpcGetters[peer]; !ok {
+			getter.conn.Close()
+		}
+	}
+}
+
+// AddPeer adds peers to the pool, only the keys that hash to the
+// new peers move. Peers already in the pool or that can't be dialed
+// are skipped
+func (p *GRPCPool) AddPeer(peers ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r := p.loadRing().clone()
+	p.add(r, nil, peers)
+	p.ring.Store(r)
+}
+
+// add put peers on the ring of r once each, a peer other than self
+// goes on it with its getter, taken from kept or dialed
+func (p *GRPCPool) add(r *grpcRing, kept map[string]*grpcGetter, peers []string) {
+	for _, peer := range peers {
+		if peer == p.self {
+			if !r.hasSelf {
+				r.peers.Add(peer)
+				r.hasSelf = true
+			}
+			continue
+		}
+		if _, ok := r.grpcGetters[peer]; ok {
+			continue
+		}
+		getter, ok := kept[peer]
+		if !ok {
+			if getter = p.dial(peer); getter == nil {
+				continue
+			}
+		}
+		r.peers.Add(peer)
+		r.grpcGetters[peer] = getter
+	}
+}
+
+// RemovePeer removes peers from the pool and closes the
+// connections to them, only the keys owned by them move
+func (p *GRPCPool) RemovePeer(peers ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r := p.loadRing().clone()
+	r.peers.Remove(peers...)
+	var closing []*grpcGetter
+	for _, peer := range peers {
+		if peer == p.self {
+			r.hasSelf = false
+		}
+		if getter, ok := r.grpcGetters[peer]; ok {
+			closing = append(closing, getter)
+			delete(r.grpcGetters, peer)
+		}
+	}
+	p.ring.Store(r)
+	for _, getter := range closing {
+		getter.conn.Close()
+	}
+}
+
+// PickPeer pick a peer according a key
+func (p *GRPCPool) PickPeer(key string) (peer PeerGetter, ok bool) {
+	r := p.loadRing()
+	if r.peers.IsEmpty() {
+		return nil, false
+	}
+	if peer := r.peers.Get(key); peer != p.self {
+		if getter, ok := r.grpcGetters[peer]; ok {
+			return getter, true
+		}
+	}
+	return nil, false
+}
+
+// PickFallback return the first live peer after the owner of key on
+// the ring, the peers whose connection is failing are skipped
+func (p *GRPCPool) PickFallback(key string) (PeerGetter, bool) {
+	r := p.loadRing()
+	peers := r.peers.GetN(key, len(r.grpcGetters)+1)
+	if len(peers) == 0 || peers[0] == p.self {
+		return nil, false
+	}
+	for _, peer := range peers[1:] {
+		if peer == p.self {
+			return nil, true
+		}
+		if getter, ok := r.grpcGetters[peer]; ok && getter.healthy() {
+			return getter, true
+		}
+	}
+	return nil, false
+}
+
+// Close closes the connections to all peers
+func (p *GRPCPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old := p.loadRing()
+	p.ring.Store(&grpcRing{
+		peers:       consistenthash.New(defaultReplicas, nil),
+		grpcGetters: make(map[string]*grpcGetter),
+	})
+	for _, getter := range old.grpcGetters {
+		getter.conn.Close()
+	}
+}
+
+func (p *GRPCPool) loadRing() *grpcRing {
+	return p.ring.Load().(*grpcRing)
+}
+
+// dial return nil for a peer that can't be dialed, the error is logged
+func (p *GRPCPool) dial(peer string) *grpcGetter {
+	conn, err := grpc.Dial(peer, p.dialOpts...)
+	if err != nil {
+		p.Log("dial %s: %v", peer, err)
+		return nil
+	}
+	return &grpcGetter{conn: conn, client: pb.NewGroupCacheClient(conn)}
+}
+
+func (r *grpcRing) clone() *grpcRing {
+	c := &grpcRing{
+		peers:       r.peers.Clone(),
+		grpcGetters: make(map[string]*grpcGetter, len(r.grpcGetters)),
+		hasSelf:     r.hasSelf,
+	}
+	for peer, getter := range r.grpcGetters {
+		c.grpcGetters[peer] = getter
+	}
+	return c
+}
+
+// Server return the GroupCache service serving the local groups,
+// it is registered with pb.RegisterGroupCacheServer
+func (p *GRPCPool) Server() pb.GroupCacheServer {
+	return &grpcServer{}
+}
+
+// grpcServer implements the GroupCache service
+type grpcServer struct {
+	pb.UnimplementedGroupCacheServer
+}
+
+// Get implements the GroupCache service Get method
+func (s *grpcServer) Get(ctx context.Context, in *pb.Request) (*pb.Response, error) {
+	group, err := s.group(in)
+	if err != nil {
+		return nil, err
+	}
+	group.stats.serverRequests.Add(1)
+	if in.GetForwarded() {
+		ctx = withForwarded(ctx, forwardKindOf(in.GetFallback(), in.GetBounded()))
+	}
+	view, stale, err := group.get(ctx, in.GetKey())
+	if errors.Is(err, ErrNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.Response{Value: view.ByteSlice(), Stale: stale}, nil
+}
+
+// Delete implements the GroupCache service Delete method
+func (s *grpcServer) Delete(ctx context.Context, in *pb.Request) (*pb.DeleteResponse, error) {
+	group, err := s.group(in)
+	if err != nil {
+		return nil, err
+	}
+	group.removeLocally(in.GetKey())
+	return &pb.DeleteResponse{}, nil
+}
+
+// Set implements the GroupCache service Set method
+func (s *grpcServer) Set(ctx context.Context, in *pb.SetRequest) (*pb.SetResponse, error) {
+	group, err := s.group(&pb.Request{Group: in.GetGroup(), Key: in.GetKey()})
+	if err != nil {
+		return nil, err
+	}
+	group.setLocally(in.GetKey(), in.GetValue())
+	return &pb.SetResponse{}, nil
+}
+
+// GetMulti implements the GroupCache service GetMulti method
+func (s *grpcServer) GetMulti(ctx context.Context, in *pb.MultiRequest) (*pb.MultiResponse, error) {
+	group := GetGroup(in.GetGroup())
+	if group == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "no such group: %s", in.GetGroup())
+	}
+	group.stats.serverRequests.Add(1)
+	if in.GetForwarded() {
+		ctx = withForwarded(ctx, forwardKindOf(false, in.GetBounded()))
+	}
+	return multiResponse(group.getMulti(ctx, in.GetKeys())), nil
+}
+
+func (s *grpcServer) group(in *pb.Request) (*Group, error) {
+	if in.GetKey() == "" {
+		return nil, status.Error(codes.InvalidArgument, "require key")
+	}
+	group := GetGroup(in.GetGroup())
+	if group == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "no such group: %s", in.GetGroup())
+	}
+	return group, nil
+}
+
+var _ PeerPicker = (*GRPCPool)(nil)
+var _ pb.GroupCacheServer = (*grpcServer)(nil)
+
+type grpcGetter struct {
+	conn   *grpc.ClientConn
+	client pb.GroupCacheClient
+}
+
+// healthy report whether the connection to the peer is not failing
+func (g *grpcGetter) healthy() bool {
+	state := g.conn.GetState()
+	return state != connectivity.TransientFailure && state != connectivity.Shutdown
+}
+
+func (g *grpcGetter) Get(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	res, err := g.client.Get(ctx, in)
+	if status.Code(err) == codes.NotFound {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	out.Value = res.Value
+	out.Stale = res.Stale
+	return nil
+}
+
+func (g *grpcGetter) Delete(ctx context.Context, in *pb.Request, out *pb.DeleteResponse) error {
+	_, err := g.client.Delete(ctx, in)
+	return err
+}
+
+func (g *grpcGetter) Set(ctx context.Context, in *pb.SetRequest, out *pb.SetResponse) error {
+	_, err := g.client.Set(ctx, in)
+	return err
+}
+
+func (g *grpcGetter) GetMulti(ctx context.Context, in *pb.MultiRequest, out *pb.MultiResponse) error {
+	res, err := g.client.GetMulti(ctx, in)
+	if err != nil {
+		return err
+	}
+	out.Values = res.Values
+	out.Errors = res.Errors
+	out.Stale = res.Stale
+	return nil
+}
+
+var _ PeerGetter = (*grpcGetter)(nil)
+var _ BatchPeerGetter = (*grpcGetter)(nil)
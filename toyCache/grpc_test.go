@@ -0,0 +1,119 @@
+package toyCache
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	pb "github.com/toyCache/toyCache/toycachepb"
+	"google.golang.org/grpc"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// newTestGRPCPeer serves a GRPCPool and return a pool connected to it
+func newTestGRPCPeer(t *testing.T) (*GRPCPool, string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	pb.RegisterGroupCacheServer(server, NewGRPCPool(lis.Addr().String()).Server())
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	client := NewGRPCPool("127.0.0.1:0")
+	client.Set(lis.Addr().String())
+	t.Cleanup(client.Close)
+	return client, lis.Addr().String()
+}
+
+func TestGRPCPool(t *testing.T) {
+	loads := 0
+	NewGroup("grpc", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}))
+	client, addr := newTestGRPCPeer(t)
+	peer, ok := client.PickPeer("Tom")
+	require.True(t, ok, "key should be owned by %s", addr)
+
+	ctx := context.Background()
+	req := &pb.Request{Group: "grpc", Key: "Tom"}
+	res := &pb.Response{}
+	require.NoError(t, peer.Get(ctx, req, res))
+	require.Equal(t, "Tom", string(res.Value))
+	require.NoError(t, peer.Get(ctx, req, res))
+	require.Equal(t, 1, loads)
+
+	require.NoError(t, peer.Delete(ctx, req, &pb.DeleteResponse{}))
+	require.NoError(t, peer.Get(ctx, req, res))
+	require.Equal(t, 2, loads, "deleted key should be loaded again")
+
+	require.NoError(t, peer.Set(ctx, &pb.SetRequest{Group: "grpc", Key: "Tom", Value: []byte("630")}, &pb.SetResponse{}))
+	require.NoError(t, peer.Get(ctx, req, res))
+	require.Equal(t, "630", string(res.Value))
+	require.Equal(t, 2, loads, "set key should not be loaded")
+
+	multi := &pb.MultiResponse{}
+	require.NoError(t, peer.(BatchPeerGetter).GetMulti(ctx, &pb.MultiRequest{Group: "grpc", Keys: []string{"Tom", "Bob"}}, multi))
+	require.Equal(t, map[string][]byte{"Tom": []byte("630"), "Bob": []byte("Bob")}, multi.Values)
+
+	err := peer.Get(ctx, &pb.Request{Group: "grpcUnknown", Key: "Tom"}, res)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrNotFound, "unknown group is not a missing key")
+}
+
+func TestGRPCPoolNotFound(t *testing.T) {
+	NewGroup("grpcNotFound", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return nil, ErrNotFound
+	}))
+	client, _ := newTestGRPCPeer(t)
+	peer, ok := client.PickPeer("Tom")
+	require.True(t, ok)
+	err := peer.Get(context.Background(), &pb.Request{Group: "grpcNotFound", Key: "Tom"}, &pb.Response{})
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestGRPCPoolPickFallback(t *testing.T) {
+	pool := NewGRPCPool("127.0.0.1:8001")
+	pool.Set("127.0.0.1:8001", "127.0.0.1:8002", "127.0.0.1:8003")
+	t.Cleanup(pool.Close)
+	r := pool.loadRing()
+	var key string
+	for i := 0; ; i++ {
+		key = strconv.Itoa(i)
+		if peers := r.peers.GetN(key, 3); peers[0] != pool.self && peers[1] != pool.self {
+			break
+		}
+	}
+	peers := r.peers.GetN(key, 3)
+	fallback, ok := pool.PickFallback(key)
+	require.True(t, ok)
+	require.Equal(t, r.grpcGetters[peers[1]], fallback, "successor should take over the key")
+
+	r.grpcGetters[peers[1]].conn.Close()
+	fallback, ok = pool.PickFallback(key)
+	require.True(t, ok)
+	require.Nil(t, fallback, "a peer whose connection failed should be skipped")
+}
+
+func TestGRPCPoolAddPeer(t *testing.T) {
+	self := "127.0.0.1:8001"
+	want := NewGRPCPool(self)
+	want.Set(self, "127.0.0.1:8002")
+	defer want.Close()
+	pool := NewGRPCPool(self)
+	defer pool.Close()
+	pool.AddPeer(self, "127.0.0.1:8002")
+	pool.AddPeer(self, "127.0.0.1:8002")
+	require.Len(t, pool.loadRing().grpcGetters, 1)
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		_, ok := pool.PickPeer(key)
+		_, wantOK := want.PickPeer(key)
+		require.Equal(t, wantOK, ok, "adding peers again should not change the ring")
+	}
+
+	// without transport credentials the dial fails
+	failing := NewGRPCPool(self, grpc.WithUserAgent("test"))
+	failing.AddPeer("127.0.0.1:8002")
+	require.True(t, failing.loadRing().peers.IsEmpty(), "peer that can't be dialed should not be on the ring")
+}
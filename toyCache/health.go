@@ -0,0 +1,200 @@
+package toyCache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthPath = "/_health"
+	defaultPeersPath  = "/_peers"
+
+	// defaultFailureThreshold consecutive failures eject a peer
+	defaultFailureThreshold = 3
+	// defaultEjectTimeout is how long an ejected peer is skipped
+	// before a single trial request is let through
+	defaultEjectTimeout = 10 * time.Second
+	// defaultTrialTimeout is how long a trial request may go without an
+	// outcome before another one is let through
+	defaultTrialTimeout = 10 * time.Second
+)
+
+// errEjected is returned for a request to an ejected peer, another
+// caller holds its trial request
+var errEjected = errors.New("toyCache: peer is ejected")
+
+// peerState is the circuit breaker state of a peer
+type peerState int
+
+const (
+	peerHealthy peerState = iota // requests flow to the peer
+	peerEjected                  // the peer is skipped until retryAt
+	peerProbing                  // one trial request is in flight until retryAt
+)
+
+func (s peerState) String() string {
+	switch s {
+	case peerHealthy:
+		return "healthy"
+	case peerEjected:
+		return "ejected"
+	case peerProbing:
+		return "probing"
+	default:
+		return "unknown"
+	}
+}
+
+// breaker tracks the health of a peer from the outcome of the
+// requests sent to it and of the active probes
+type breaker struct {
+	mu       sync.Mutex
+	state    peerState
+	failures int // consecutive failures
+	retryAt  time.Time
+	lastErr  string
+}
+
+// allow report whether a request may be sent to the peer, once the eject
+// timeout passed the first caller is let through as the trial request.
+// A trial that never reports back is replaced after defaultTrialTimeout
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == peerHealthy {
+		return true
+	}
+	if time.Now().Before(b.retryAt) {
+		return false
+	}
+	b.state = peerProbing
+	b.retryAt = time.Now().Add(defaultTrialTimeout)
+	return true
+}
+
+// available report whether allow would let a request through,
+// without starting a trial request
+func (b *breaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == peerHealthy || !time.Now().Before(b.retryAt)
+}
+
+// abort ends a trial request given up by its caller, it says nothing
+// about the peer so the next request is the new trial
+func (b *breaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == peerProbing {
+		b.state = peerEjected
+		b.retryAt = time.Now()
+	}
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = peerHealthy
+	b.failures = 0
+}
+
+func (b *breaker) failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.lastErr = err.Error()
+	if b.state == peerProbing || b.failures >= defaultFailureThreshold {
+		b.state = peerEjected
+		b.retryAt = time.Now().Add(defaultEjectTimeout)
+	}
+}
+
+// PeerStatus is the health of a peer as reported by the admin endpoint
+type PeerStatus struct {
+	Peer      string    `json:"peer"`
+	State     string    `json:"state"`
+	Failures  int       `json:"failures"`
+	RetryAt   time.Time `json:"retryAt"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+func (b *breaker) status(peer string) PeerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := PeerStatus{
+		Peer:      peer,
+		State:     b.state.String(),
+		Failures:  b.failures,
+		LastError: b.lastErr,
+	}
+	if b.state != peerHealthy {
+		s.RetryAt = b.retryAt
+	}
+	return s
+}
+
+// PeerStatus return the health of every peer in the pool
+func (h *HTTPPool) PeerStatus() []PeerStatus {
+	r := h.loadRing()
+	list := make([]PeerStatus, 0, len(r.httpGetter))
+	for peer, getter := range r.httpGetter {
+		if peer == h.self {
+			continue
+		}
+		list = append(list, getter.health.status(peer))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Peer < list[j].Peer
+	})
+	return list
+}
+
+// StartHealthCheck probes every peer each interval, peers failing the
+// probes are ejected like peers failing requests. Calling stop ends it
+func (h *HTTPPool) StartHealthCheck(interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				h.probePeers(ctx, interval)
+			}
+		}
+	}()
+	return cancel
+}
+
+func (h *HTTPPool) probePeers(ctx context.Context, timeout time.Duration) {
+	var wg sync.WaitGroup
+	for peer, getter := range h.loadRing().httpGetter {
+		if peer == h.self {
+			continue
+		}
+		wg.Add(1)
+		go func(getter *httpGetter) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			if err := getter.probe(ctx); err != nil {
+				getter.health.failure(err)
+			} else {
+				getter.health.success()
+			}
+		}(getter)
+	}
+	wg.Wait()
+}
+
+func (h *HTTPPool) servePeers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.PeerStatus())
+}
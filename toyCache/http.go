@@ -1,43 +1,148 @@
 package toyCache
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/toyCache/toyCache/consistenthash"
 	pb "github.com/toyCache/toyCache/toycachepb"
 	"google.golang.org/protobuf/proto"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	defaultBasePath = "/_toyCache"
-	defaultReplicas = 50
+	defaultBasePath            = "/_toyCache"
+	defaultMultiPath           = "/_multi"
+	defaultReplicas            = 50
+	defaultRetryBackoff        = 50 * time.Millisecond
+	defaultMaxIdleConnsPerPeer = 16
+
+	// forwardedHeader marks the requests a peer forwards, its value is
+	// fallback or bounded when sent in place of the failed or overloaded owner
+	forwardedHeader = "X-Toycache-Forwarded"
+	fallbackValue   = "fallback"
+	boundedValue    = "bounded"
 )
 
 // HTTPPool implement a PeerPick for a pool of HTTP peers.
 type HTTPPool struct {
-	self       string
-	basePath   string
-	mu         sync.Mutex // guards peer and httpGetter
+	inflight int64 // requests being served, accessed atomically
+	self     string
+	basePath string
+	opts     HTTPPoolOptions
+	client   *http.Client // shared by every httpGetter
+	mu       sync.Mutex   // serializes updates of ring
+	ring     atomic.Value // holds *httpRing, swapped on every update
+}
+
+// HTTPPoolOptions are the configurations of a HTTPPool
+type HTTPPoolOptions struct {
+	// BasePath specifies the HTTP path that will serve toyCache requests.
+	// If blank, it defaults to "/_toyCache".
+	BasePath string
+
+	// Replicas specifies the number of key replicas on the consistent hash.
+	// If blank, it defaults to 50.
+	Replicas int
+
+	// HashFn specifies the hash function of the consistent hash.
+	// If blank, it defaults to crc32.ChecksumIEEE.
+	HashFn consistenthash.Hash
+
+	// Timeout bounds every attempt of a request sent to a peer.
+	// If blank, attempts are only bounded by the caller context.
+	Timeout time.Duration
+
+	// Retries specifies how many times a request failing on the
+	// network is sent again. If blank, it is not retried.
+	Retries int
+
+	// RetryBackoff is the wait before the first retry, it doubles
+	// on each following retry. If blank, it defaults to 50ms.
+	RetryBackoff time.Duration
+
+	// MaxIdleConnsPerPeer specifies the idle connections kept open to
+	// each peer. If blank, it defaults to 16. Ignored with Transport.
+	MaxIdleConnsPerPeer int
+
+	// Transport specifies the http.RoundTripper used for peer requests.
+	// If nil, a copy of http.DefaultTransport is used.
+	Transport http.RoundTripper
+
+	// ReplicationFactor specifies on how many peers each key is stored,
+	// the owner fills the others. If blank, keys are only on their owner.
+	ReplicationFactor int
+
+	// Weights specifies the relative capacity of peers, a peer of weight 2
+	// owns twice as many keys. If blank, every peer has weight 1.
+	Weights map[string]int
+
+	// LoadBound enables consistent hashing with bounded loads, a key goes
+	// to the next peer on the ring while its owner has more than
+	// (1+LoadBound) times its share of the in-flight requests. Each node
+	// only counts the requests it serves and the ones it sent, so it
+	// balances its own traffic, not the load of the whole cluster.
+	// If blank, keys always go to their owner.
+	LoadBound float64
+}
+
+// httpRing is an immutable snapshot of the pool' peers, PickPeer reads
+// it without locking while updates build and store a new one
+type httpRing struct {
 	peers      *consistenthash.Map
 	httpGetter map[string]*httpGetter // keyed by e.g. "http://10.0.0.2:8008"
 }
 
 // NewHTTPPool initializes an HTTP pool of peers
 func NewHTTPPool(self string) *HTTPPool {
-	return &HTTPPool{
-		self:     self,
-		basePath: defaultBasePath,
+	return NewHTTPPoolOpts(self, nil)
+}
+
+// NewHTTPPoolOpts initializes an HTTP pool of peers with the given options,
+// a nil o use the defaults
+func NewHTTPPoolOpts(self string, o *HTTPPoolOptions) *HTTPPool {
+	h := &HTTPPool{self: self}
+	if o != nil {
+		h.opts = *o
 	}
+	if h.opts.BasePath == "" {
+		h.opts.BasePath = defaultBasePath
+	}
+	if h.opts.Replicas == 0 {
+		h.opts.Replicas = defaultReplicas
+	}
+	if h.opts.RetryBackoff == 0 {
+		h.opts.RetryBackoff = defaultRetryBackoff
+	}
+	if h.opts.MaxIdleConnsPerPeer == 0 {
+		h.opts.MaxIdleConnsPerPeer = defaultMaxIdleConnsPerPeer
+	}
+	if h.opts.Transport == nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.MaxIdleConnsPerHost = h.opts.MaxIdleConnsPerPeer
+		h.opts.Transport = t
+	}
+	h.basePath = h.opts.BasePath
+	h.client = &http.Client{Transport: h.opts.Transport}
+	h.ring.Store(&httpRing{
+		peers:      h.newMap(),
+		httpGetter: make(map[string]*httpGetter),
+	})
+	return h
 }
 
 // Log HTTPPool info with peer name
 func (h *HTTPPool) Log(format string, v ...interface{}) {
-	log.Printf("[Server %s] %s", h.self, fmt.Sprintf(format, v))
+	log.Printf("[Server %s] %s", h.self, fmt.Sprintf(format, v...))
 }
 
 // Set update the pool' list of peer,
@@ -47,33 +152,178 @@ func (h *HTTPPool) Set(peers ...string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	h.peers = consistenthash.New(defaultReplicas, nil)
-	h.peers.Add(peers...)
-	h.httpGetter = make(map[string]*httpGetter, len(peers))
+	old := h.loadRing()
+	r := &httpRing{
+		peers:      h.newMap(),
+		httpGetter: make(map[string]*httpGetter, len(peers)),
+	}
 	for _, peer := range peers {
-		h.httpGetter[peer] = &httpGetter{baseURL: peer + h.basePath}
+		r.peers.AddWeighted(peer, h.opts.Weights[peer])
+		if getter, ok := old.httpGetter[peer]; ok {
+			r.httpGetter[peer] = getter
+		} else {
+			r.httpGetter[peer] = h.newGetter(peer)
+		}
 	}
+	h.ring.Store(r)
 }
 
-// PickPeer pick a peer according a key
-func (h *HTTPPool) PickPeer(key string) (peer PeerGetter, ok bool) {
+// AddPeer adds peers to the pool, only the keys that
+// hash to the new peers move
+func (h *HTTPPool) AddPeer(peers ...string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	if h.peers.IsEmpty() {
+	r := h.loadRing().clone()
+	for _, peer := range peers {
+		if _, ok := r.httpGetter[peer]; ok {
+			continue
+		}
+		r.peers.AddWeighted(peer, h.opts.Weights[peer])
+		r.httpGetter[peer] = h.newGetter(peer)
+	}
+	h.ring.Store(r)
+}
+
+// RemovePeer removes peers from the pool, only the keys
+// owned by them move
+func (h *HTTPPool) RemovePeer(peers ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := h.loadRing().clone()
+	r.peers.Remove(peers...)
+	for _, peer := range peers {
+		delete(r.httpGetter, peer)
+	}
+	h.ring.Store(r)
+}
+
+// PickPeer pick a peer according a key
+func (h *HTTPPool) PickPeer(key string) (peer PeerGetter, ok bool) {
+	r := h.loadRing()
+	if r.peers.IsEmpty() {
 		return nil, false
 	}
-	if peer := h.peers.Get(key); peer != h.self {
-		return h.httpGetter[peer], true
+	if peer := h.owner(r, key); peer != h.self {
+		getter := r.httpGetter[peer]
+		if !getter.health.available() {
+			// the owner is ejected, load locally until it recovers
+			return nil, false
+		}
+		if h.opts.LoadBound > 0 && peer != r.peers.Get(key) {
+			return boundedGetter{getter}, true
+		}
+		return getter, true
 	}
 	return nil, false
 }
 
+// owner return the peer a key goes to, with LoadBound it is the
+// first peer on the ring which is not overloaded. The load of a peer
+// is only what this node sees: the requests it serves for itself and
+// the ones it sent to the peer, not those of the other nodes
+func (h *HTTPPool) owner(r *httpRing, key string) string {
+	if h.opts.LoadBound <= 0 {
+		return r.peers.Get(key)
+	}
+	return r.peers.GetBounded(key, h.opts.LoadBound, func(peer string) int64 {
+		if peer == h.self {
+			return atomic.LoadInt64(&h.inflight)
+		}
+		return atomic.LoadInt64(&r.httpGetter[peer].inflight)
+	})
+}
+
+// PickFallback return the first live peer after the owner of key on
+// the ring, the ejected peers are skipped
+func (h *HTTPPool) PickFallback(key string) (PeerGetter, bool) {
+	r := h.loadRing()
+	owner := h.owner(r, key)
+	if owner == h.self {
+		return nil, false
+	}
+	for _, peer := range r.peers.GetN(key, len(r.httpGetter)+1) {
+		if peer == owner {
+			continue
+		}
+		if peer == h.self {
+			return nil, true
+		}
+		if getter := r.httpGetter[peer]; getter.health.available() {
+			return getter, true
+		}
+	}
+	return nil, false
+}
+
+// PickReplicas return the ReplicationFactor peers holding key, the
+// ejected ones are left out
+func (h *HTTPPool) PickReplicas(key string) []PeerGetter {
+	if h.opts.ReplicationFactor <= 1 {
+		return nil
+	}
+	r := h.loadRing()
+	var replicas []PeerGetter
+	for _, peer := range r.peers.GetN(key, h.opts.ReplicationFactor) {
+		if peer == h.self {
+			replicas = append(replicas, nil)
+		} else if getter := r.httpGetter[peer]; getter.health.available() {
+			replicas = append(replicas, getter)
+		}
+	}
+	return replicas
+}
+
+func (h *HTTPPool) loadRing() *httpRing {
+	return h.ring.Load().(*httpRing)
+}
+
+func (h *HTTPPool) newMap() *consistenthash.Map {
+	return consistenthash.New(h.opts.Replicas, h.opts.HashFn)
+}
+
+func (h *HTTPPool) newGetter(peer string) *httpGetter {
+	return &httpGetter{
+		baseURL: peer + h.basePath + "/",
+		client:  h.client,
+		opts:    &h.opts,
+		latency: newHistogram(),
+		health:  &breaker{},
+	}
+}
+
+func (r *httpRing) clone() *httpRing {
+	c := &httpRing{
+		peers:      r.peers.Clone(),
+		httpGetter: make(map[string]*httpGetter, len(r.httpGetter)),
+	}
+	for peer, getter := range r.httpGetter {
+		c.httpGetter[peer] = getter
+	}
+	return c
+}
+
 // ServeHTTP handle all http request
 func (h *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == defaultMetricsPath {
+		h.ServeMetrics(w, r)
+		return
+	}
 	if !strings.HasPrefix(r.URL.Path, h.basePath) {
 		panic("HTTPPool serving unexpected path: " + r.URL.Path)
 	}
+	switch r.URL.Path {
+	case h.basePath + defaultHealthPath:
+		w.Write([]byte("ok"))
+		return
+	case h.basePath + defaultPeersPath:
+		h.servePeers(w, r)
+		return
+	case h.basePath + defaultMultiPath:
+		h.serveMulti(w, r)
+		return
+	}
 	h.Log("%s %s", r.Method, r.URL.Path)
 
 	// /<basePath>/<groupName>/<key> required
@@ -86,58 +336,285 @@ func (h *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	groupName := parts[0]
 	key := parts[1]
 
-	group := groups[groupName]
+	group := GetGroup(groupName)
 	if group == nil {
 		http.Error(w, fmt.Sprintf("no such group: %s", groupName), http.StatusBadRequest)
 		return
 	}
+	atomic.AddInt64(&h.inflight, 1)
+	defer atomic.AddInt64(&h.inflight, -1)
 
-	view, err := group.Get(key)
+	var body []byte
+	var err error
+	switch r.Method {
+	case http.MethodDelete:
+		group.removeLocally(key)
+		body, err = proto.Marshal(&pb.DeleteResponse{})
+	case http.MethodPut:
+		var value []byte
+		if value, err = ioutil.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		group.setLocally(key, value)
+		body, err = proto.Marshal(&pb.SetResponse{})
+	default:
+		group.stats.serverRequests.Add(1)
+		var view ByteView
+		var stale bool
+		view, stale, err = group.get(forwardedContext(r), key)
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Write the value to the response body as a proto message
+		body, err = proto.Marshal(&pb.Response{Value: view.ByteSlice(), Stale: stale})
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Write the value to the response body as a proto message
-	body, err := proto.Marshal(&pb.Response{Value: view.ByteSlice()})
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(body)
+}
+
+// forwardedContext return the context of r, marked when a peer forwarded r
+func forwardedContext(r *http.Request) context.Context {
+	if v := r.Header.Get(forwardedHeader); v != "" {
+		return withForwarded(r.Context(), forwardKindOf(v == fallbackValue, v == boundedValue))
+	}
+	return r.Context()
+}
+
+// serveMulti answer a GetMulti of a peer, the body is a MultiRequest
+func (h *HTTPPool) serveMulti(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	in := &pb.MultiRequest{}
+	if err := proto.Unmarshal(b, in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	group := GetGroup(in.GetGroup())
+	if group == nil {
+		http.Error(w, fmt.Sprintf("no such group: %s", in.GetGroup()), http.StatusBadRequest)
+		return
+	}
+	group.stats.serverRequests.Add(1)
+	ctx := r.Context()
+	if in.GetForwarded() {
+		ctx = withForwarded(ctx, forwardKindOf(false, in.GetBounded()))
+	}
+	body, err := proto.Marshal(multiResponse(group.getMulti(ctx, in.GetKeys())))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Write(body)
 }
 
 var _ PeerPicker = (*HTTPPool)(nil)
+var _ ReplicaPicker = (*HTTPPool)(nil)
 
 type httpGetter struct {
-	baseURL string
+	inflight int64 // requests sent and not answered, accessed atomically
+	baseURL  string
+	client   *http.Client
+	opts     *HTTPPoolOptions
+	latency  *histogram
+	health   *breaker
 }
 
-func (g *httpGetter) Get(in *pb.Request, out *pb.Response) error {
-	u := fmt.Sprintf("%v%v/%v",
-		g.baseURL,
-		url.QueryEscape(in.GetGroup()),
-		url.QueryEscape(in.GetKey()),
-		)
-	res, err := http.Get(u)
+func (g *httpGetter) Get(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	if in.GetForwarded() {
+		ctx = withForwarded(ctx, forwardKindOf(in.GetFallback(), in.GetBounded()))
+	}
+	return g.do(ctx, http.MethodGet, g.keyURL(in.GetGroup(), in.GetKey()), nil, out)
+}
+
+func (g *httpGetter) Delete(ctx context.Context, in *pb.Request, out *pb.DeleteResponse) error {
+	return g.do(ctx, http.MethodDelete, g.keyURL(in.GetGroup(), in.GetKey()), nil, out)
+}
+
+// Set sends the value as the raw body of a PUT
+func (g *httpGetter) Set(ctx context.Context, in *pb.SetRequest, out *pb.SetResponse) error {
+	body := in.GetValue()
+	if body == nil {
+		body = []byte{}
+	}
+	return g.do(ctx, http.MethodPut, g.keyURL(in.GetGroup(), in.GetKey()), body, out)
+}
+
+func (g *httpGetter) GetMulti(ctx context.Context, in *pb.MultiRequest, out *pb.MultiResponse) error {
+	body, err := proto.Marshal(in)
 	if err != nil {
 		return err
 	}
+	return g.do(ctx, http.MethodPost, g.baseURL+defaultMultiPath[1:], body, out)
+}
+
+// boundedGetter is the peer a key goes to in place of its overloaded
+// owner, its requests are marked so the peer doesn't count them as a
+// ring disagreement
+type boundedGetter struct {
+	*httpGetter
+}
+
+func (g boundedGetter) Get(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	in = proto.Clone(in).(*pb.Request)
+	in.Bounded = true
+	return g.httpGetter.Get(ctx, in, out)
+}
+
+func (g boundedGetter) GetMulti(ctx context.Context, in *pb.MultiRequest, out *pb.MultiResponse) error {
+	in = proto.Clone(in).(*pb.MultiRequest)
+	in.Bounded = true
+	return g.httpGetter.GetMulti(ctx, in, out)
+}
+
+func (g *httpGetter) keyURL(group, key string) string {
+	return fmt.Sprintf("%v%v/%v",
+		g.baseURL,
+		url.QueryEscape(group),
+		url.QueryEscape(key),
+	)
+}
+
+// do sends the request and retries it with backoff while it fails on the
+// network, the peer health is updated from the final outcome
+func (g *httpGetter) do(ctx context.Context, method, u string, reqBody []byte, out proto.Message) error {
+	// the trial request of an ejected peer starts here, every path
+	// below reports its outcome
+	if !g.health.allow() {
+		return errEjected
+	}
+	atomic.AddInt64(&g.inflight, 1)
+	defer atomic.AddInt64(&g.inflight, -1)
+	backoff := g.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		body, err := g.roundTrip(ctx, method, u, reqBody)
+		if err == nil {
+			g.health.success()
+			return proto.Unmarshal(body, out)
+		}
+		// a request given up by the caller says nothing about the peer
+		if ctx.Err() != nil {
+			g.health.abort()
+			return err
+		}
+		if !isRetryable(err) {
+			// the peer answered, so it is up
+			g.health.success()
+			if se, ok := err.(*statusError); ok && se.code == http.StatusNotFound {
+				return ErrNotFound
+			}
+			return err
+		}
+		if attempt >= g.opts.Retries {
+			g.health.failure(err)
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			g.health.abort()
+			return ctx.Err()
+		}
+	}
+}
+
+// statusError is returned when a peer answers with a non 200 status
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("server returned %v", e.code)
+}
+
+// isRetryable report whether the peer could not serve the request at all,
+// other errors come from the peer itself and would fail again
+func isRetryable(err error) bool {
+	if se, ok := err.(*statusError); ok {
+		return se.code == http.StatusBadGateway ||
+			se.code == http.StatusServiceUnavailable ||
+			se.code == http.StatusGatewayTimeout
+	}
+	return true
+}
+
+func (g *httpGetter) roundTrip(ctx context.Context, method, u string, body []byte) ([]byte, error) {
+	if g.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.opts.Timeout)
+		defer cancel()
+	}
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if isForwarded(ctx) {
+		switch forwardedKind(ctx) {
+		case forwardFallback:
+			req.Header.Set(forwardedHeader, fallbackValue)
+		case forwardBounded:
+			req.Header.Set(forwardedHeader, boundedValue)
+		default:
+			req.Header.Set(forwardedHeader, "1")
+		}
+	}
+	start := time.Now()
+	res, err := g.client.Do(req)
+	g.latency.observe(time.Since(start))
+	if err != nil {
+		return nil, err
+	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("server returned %v",res.StatusCode)
+		return nil, &statusError{code: res.StatusCode}
 	}
 	bytes, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return fmt.Errorf("reading response body %v", err)
+		return nil, fmt.Errorf("reading response body %v", err)
 	}
+	return bytes, nil
+}
 
-	if err = proto.Unmarshal(bytes, out); err != nil {
+// probe checks that the peer is up and serving
+func (g *httpGetter) probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.baseURL+defaultHealthPath[1:], nil)
+	if err != nil {
+		return err
+	}
+	res, err := g.client.Do(req)
+	if err != nil {
 		return err
 	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned %v", res.StatusCode)
+	}
 	return nil
 }
 
-var _ PeerGetter = (*httpGetter)(nil)
\ No newline at end of file
+var _ PeerGetter = (*httpGetter)(nil)
+var _ BatchPeerGetter = (*httpGetter)(nil)
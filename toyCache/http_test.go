@@ -0,0 +1,365 @@
+package toyCache
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	pb "github.com/toyCache/toyCache/toycachepb"
+	"google.golang.org/protobuf/proto"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestPeer serves group through an HTTPPool and return a getter for it
+func newTestPeer(t *testing.T) *httpGetter {
+	pool := NewHTTPPool("")
+	srv := httptest.NewServer(pool)
+	t.Cleanup(srv.Close)
+	return pool.newGetter(srv.URL)
+}
+
+func TestHTTPGetterDelete(t *testing.T) {
+	loads := 0
+	NewGroup("httpDelete", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}))
+	peer := newTestPeer(t)
+	req := &pb.Request{Group: "httpDelete", Key: "Tom"}
+	ctx := context.Background()
+
+	res := &pb.Response{}
+	require.NoError(t, peer.Get(ctx, req, res))
+	require.Equal(t, "Tom", string(res.Value))
+	require.NoError(t, peer.Get(ctx, req, res))
+	require.Equal(t, 1, loads)
+
+	require.NoError(t, peer.Delete(ctx, req, &pb.DeleteResponse{}))
+	require.NoError(t, peer.Get(ctx, req, res))
+	require.Equal(t, 2, loads, "deleted key should be loaded again")
+}
+
+func TestHTTPGetterSet(t *testing.T) {
+	loads := 0
+	NewGroup("httpSet", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}))
+	peer := newTestPeer(t)
+	ctx := context.Background()
+	require.NoError(t, peer.Set(ctx, &pb.SetRequest{Group: "httpSet", Key: "Tom", Value: []byte("630")}, &pb.SetResponse{}))
+
+	res := &pb.Response{}
+	require.NoError(t, peer.Get(ctx, &pb.Request{Group: "httpSet", Key: "Tom"}, res))
+	require.Equal(t, "630", string(res.Value))
+	require.Equal(t, 0, loads)
+}
+
+func TestHTTPGetterNotFound(t *testing.T) {
+	NewGroup("httpNotFound", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return nil, ErrNotFound
+	}))
+	peer := newTestPeer(t)
+	err := peer.Get(context.Background(), &pb.Request{Group: "httpNotFound", Key: "Tom"}, &pb.Response{})
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestHTTPGetterGetMulti(t *testing.T) {
+	NewGroup("httpMulti", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		if key == "Unknown" {
+			return nil, ErrNotFound
+		}
+		return []byte(key), nil
+	}))
+	peer := newTestPeer(t)
+	res := &pb.MultiResponse{}
+	req := &pb.MultiRequest{Group: "httpMulti", Keys: []string{"Tom", "Bob", "Unknown"}}
+	require.NoError(t, peer.GetMulti(context.Background(), req, res))
+	require.Equal(t, map[string][]byte{"Tom": []byte("Tom"), "Bob": []byte("Bob")}, res.Values)
+	require.Empty(t, res.Errors)
+}
+
+func TestServeMetrics(t *testing.T) {
+	toyC := NewGroup("metrics", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		_, err := getView(toyC, ctx, "Tom")
+		require.NoError(t, err)
+	}
+	pool := NewHTTPPool("http://localhost:8001")
+	pool.Set("http://localhost:8001", "http://localhost:8002")
+	pool.loadRing().httpGetter["http://localhost:8002"].latency.observe(3 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	pool.ServeHTTP(w, httptest.NewRequest(http.MethodGet, defaultMetricsPath, nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		`# TYPE toycache_gets_total counter`,
+		`toycache_gets_total{group="metrics"} 2`,
+		`toycache_hit_ratio{group="metrics"} 0.5`,
+		`toycache_cache_items{group="metrics",cache="main"} 1`,
+		`toycache_peer_request_duration_seconds_bucket{peer="http://localhost:8002",le="0.0025"} 0`,
+		`toycache_peer_request_duration_seconds_bucket{peer="http://localhost:8002",le="0.005"} 1`,
+		`toycache_peer_request_duration_seconds_count{peer="http://localhost:8002"} 1`,
+	} {
+		require.Contains(t, body, line+"\n")
+	}
+}
+
+func TestHTTPPoolAddRemovePeer(t *testing.T) {
+	self := "http://localhost:8001"
+	pool := NewHTTPPool(self)
+	_, ok := pool.PickPeer("Tom")
+	require.False(t, ok, "empty pool should not pick any peer")
+
+	pool.Set(self, "http://localhost:8002")
+	owners := make(map[string]PeerGetter)
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		owners[key], _ = pool.PickPeer(key)
+	}
+
+	pool.AddPeer("http://localhost:8003")
+	pool.RemovePeer("http://localhost:8003")
+	for key, owner := range owners {
+		peer, _ := pool.PickPeer(key)
+		require.Equal(t, owner, peer, "key %s should come back to its owner", key)
+	}
+
+	pool.RemovePeer("http://localhost:8002")
+	for key := range owners {
+		_, ok := pool.PickPeer(key)
+		require.False(t, ok, "key %s should be owned by self", key)
+	}
+}
+
+func TestHTTPPoolEjectDeadPeer(t *testing.T) {
+	NewGroup("eject", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	srv := httptest.NewServer(NewHTTPPool(""))
+	dead := "http://127.0.0.1:1"
+	pool := NewHTTPPool("http://localhost:8001")
+	pool.Set(dead)
+
+	ctx := context.Background()
+	req := &pb.Request{Group: "eject", Key: "Tom"}
+	for i := 0; i < defaultFailureThreshold; i++ {
+		peer, ok := pool.PickPeer("Tom")
+		require.True(t, ok)
+		require.Error(t, peer.Get(ctx, req, &pb.Response{}))
+	}
+	_, ok := pool.PickPeer("Tom")
+	require.False(t, ok, "dead peer should be ejected")
+
+	w := httptest.NewRecorder()
+	pool.ServeHTTP(w, httptest.NewRequest(http.MethodGet, defaultBasePath+defaultPeersPath, nil))
+	require.Contains(t, w.Body.String(), `"state":"ejected"`)
+
+	// once the eject timeout passed a single trial request is let through
+	getter := pool.loadRing().httpGetter[dead]
+	getter.health.retryAt = time.Now()
+	getter.baseURL = srv.URL + defaultBasePath + "/"
+	peer, ok := pool.PickPeer("Tom")
+	require.True(t, ok)
+	_, ok = pool.PickPeer("Tom")
+	require.True(t, ok, "picking the peer should not start the trial")
+	require.Equal(t, "ejected", getter.health.status(dead).State)
+	require.NoError(t, peer.Get(ctx, req, &pb.Response{}))
+	_, ok = pool.PickPeer("Tom")
+	require.True(t, ok, "peer should be healthy after a good trial")
+	srv.Close()
+
+	// active probes eject the peer without any request
+	pool.probePeers(ctx, time.Second)
+	pool.probePeers(ctx, time.Second)
+	pool.probePeers(ctx, time.Second)
+	_, ok = pool.PickPeer("Tom")
+	require.False(t, ok, "peer failing probes should be ejected")
+}
+
+func TestHTTPPoolCancelledTrial(t *testing.T) {
+	NewGroup("cancelledTrial", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	srv := httptest.NewServer(NewHTTPPool(""))
+	defer srv.Close()
+	pool := NewHTTPPool("http://localhost:8001")
+	pool.Set(srv.URL)
+	getter := pool.loadRing().httpGetter[srv.URL]
+	getter.health.state = peerEjected
+
+	peer, ok := pool.PickPeer("Tom")
+	require.True(t, ok, "first request should be the trial")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Error(t, peer.Get(ctx, &pb.Request{Group: "cancelledTrial", Key: "Tom"}, &pb.Response{}))
+	peer, ok = pool.PickPeer("Tom")
+	require.True(t, ok, "a cancelled trial should let the next request through")
+	require.NoError(t, peer.Get(context.Background(), &pb.Request{Group: "cancelledTrial", Key: "Tom"}, &pb.Response{}))
+	require.Equal(t, "healthy", getter.health.status(srv.URL).State)
+
+	// only one trial request is in flight, one without outcome
+	// is replaced after its timeout
+	getter.health.state = peerEjected
+	getter.health.retryAt = time.Time{}
+	require.True(t, getter.health.allow())
+	_, ok = pool.PickPeer("Tom")
+	require.False(t, ok)
+	require.ErrorIs(t, peer.Get(context.Background(), &pb.Request{Group: "cancelledTrial", Key: "Tom"}, &pb.Response{}), errEjected)
+	require.Equal(t, "probing", getter.health.status(srv.URL).State)
+	getter.health.retryAt = time.Now()
+	_, ok = pool.PickPeer("Tom")
+	require.True(t, ok, "a trial without outcome should be replaced after its timeout")
+}
+
+type countingTransport struct {
+	calls int32
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.calls, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestHTTPPoolOptions(t *testing.T) {
+	var fails int32 = 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/slow") {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if atomic.AddInt32(&fails, -1) >= 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := proto.Marshal(&pb.Response{Value: []byte("ok")})
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	transport := &countingTransport{}
+	pool := NewHTTPPoolOpts("http://localhost:8001", &HTTPPoolOptions{
+		Timeout:      20 * time.Millisecond,
+		Retries:      2,
+		RetryBackoff: time.Millisecond,
+		Transport:    transport,
+	})
+	pool.Set(srv.URL)
+	peer, ok := pool.PickPeer("Tom")
+	require.True(t, ok)
+
+	ctx := context.Background()
+	res := &pb.Response{}
+	require.NoError(t, peer.Get(ctx, &pb.Request{Group: "options", Key: "Tom"}, res))
+	require.Equal(t, "ok", string(res.Value))
+	require.Equal(t, int32(3), atomic.LoadInt32(&transport.calls), "request should be retried twice")
+
+	err := peer.Get(ctx, &pb.Request{Group: "options", Key: "slow"}, res)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, int32(6), atomic.LoadInt32(&transport.calls), "timed out request should be retried")
+}
+
+func TestHTTPPoolWeightsAndLoadBound(t *testing.T) {
+	peers := []string{"http://localhost:8001", "http://localhost:8002"}
+	pool := NewHTTPPoolOpts(peers[0], &HTTPPoolOptions{
+		Weights:   map[string]int{peers[1]: 3},
+		LoadBound: 0.25,
+	})
+	pool.Set(peers...)
+	r := pool.loadRing()
+	owned := 0
+	for i := 0; i < 1000; i++ {
+		if pool.owner(r, strconv.Itoa(i)) == peers[1] {
+			owned++
+		}
+	}
+	require.Greater(t, owned, 500, "weight 3 peer should own most keys")
+
+	var key string
+	for i := 0; ; i++ {
+		if key = strconv.Itoa(i); r.peers.Get(key) == peers[1] {
+			break
+		}
+	}
+	atomic.StoreInt64(&r.httpGetter[peers[1]].inflight, 100)
+	_, ok := pool.PickPeer(key)
+	require.False(t, ok, "key of an overloaded peer should go to the next one")
+	atomic.StoreInt64(&r.httpGetter[peers[1]].inflight, 0)
+	_, ok = pool.PickPeer(key)
+	require.True(t, ok)
+}
+
+func TestHTTPPoolForwardedRequest(t *testing.T) {
+	loads := 0
+	toyC := NewGroup("forwarded", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}))
+	pool := NewHTTPPool("")
+	// the ring of this peer says another peer owns every key
+	pool.Set("http://127.0.0.1:1")
+	toyC.RegisterPeer(pool)
+	srv := httptest.NewServer(pool)
+	t.Cleanup(srv.Close)
+	peer := pool.newGetter(srv.URL)
+
+	res := &pb.Response{}
+	require.NoError(t, peer.Get(context.Background(), &pb.Request{Group: "forwarded", Key: "Tom", Forwarded: true}, res))
+	require.Equal(t, "Tom", string(res.Value))
+	require.Equal(t, 1, loads, "forwarded request should be loaded locally")
+	require.Equal(t, int64(0), toyC.Stats().PeerErrors, "forwarded request should not be forwarded again")
+	require.Equal(t, int64(1), toyC.Stats().RingDisagreements)
+
+	multi := &pb.MultiResponse{}
+	req := &pb.MultiRequest{Group: "forwarded", Keys: []string{"Bob"}, Forwarded: true}
+	require.NoError(t, peer.GetMulti(context.Background(), req, multi))
+	require.Equal(t, []byte("Bob"), multi.Values["Bob"])
+	require.Equal(t, int64(2), toyC.Stats().RingDisagreements)
+}
+
+func TestHTTPPoolBoundedRequest(t *testing.T) {
+	toyC := NewGroup("bounded", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	pool := NewHTTPPool("")
+	pool.Set("http://127.0.0.1:1")
+	toyC.RegisterPeer(pool)
+	srv := httptest.NewServer(pool)
+	t.Cleanup(srv.Close)
+	peer := boundedGetter{pool.newGetter(srv.URL)}
+
+	res := &pb.Response{}
+	req := &pb.Request{Group: "bounded", Key: "Tom", Forwarded: true}
+	require.NoError(t, peer.Get(context.Background(), req, res))
+	require.Equal(t, "Tom", string(res.Value))
+	require.False(t, req.Bounded, "the request of the caller should be left as is")
+
+	multi := &pb.MultiResponse{}
+	require.NoError(t, peer.GetMulti(context.Background(), &pb.MultiRequest{Group: "bounded", Keys: []string{"Bob"}, Forwarded: true}, multi))
+	require.Equal(t, []byte("Bob"), multi.Values["Bob"])
+	require.Equal(t, int64(0), toyC.Stats().RingDisagreements, "a request past an overloaded owner is not a ring disagreement")
+}
+
+func TestHTTPPoolPickBounded(t *testing.T) {
+	peers := []string{"http://localhost:8001", "http://localhost:8002", "http://localhost:8003"}
+	pool := NewHTTPPoolOpts(peers[0], &HTTPPoolOptions{LoadBound: 0.25})
+	pool.Set(peers...)
+	r := pool.loadRing()
+	var key string
+	for i := 0; ; i++ {
+		key = strconv.Itoa(i)
+		if owners := r.peers.GetN(key, 2); owners[0] != peers[0] && owners[1] != peers[0] {
+			break
+		}
+	}
+	atomic.StoreInt64(&r.httpGetter[r.peers.Get(key)].inflight, 100)
+	peer, ok := pool.PickPeer(key)
+	require.True(t, ok)
+	require.IsType(t, boundedGetter{}, peer, "requests past an overloaded owner should be marked")
+}
@@ -0,0 +1,188 @@
+package lfu
+
+import (
+	"container/list"
+	"github.com/toyCache/toyCache/policy"
+	"sort"
+	"time"
+)
+
+// Cache is an LFU cache, entries used as often are evicted least recently
+// used first. It is not safe for concurrent access
+type Cache struct {
+	maxBytes int64
+	nBytes   int64
+	cache    map[string]*entry
+	freqs    map[int]*list.List // entries by use count, most recent at front
+	minFreq  int
+	expiries policy.Expiries
+	// optional and executed when an entry is purged
+	OnEvicted func(key string, value Value)
+}
+
+type entry struct {
+	key   string
+	value Value
+	freq  int
+	ele   *list.Element
+}
+
+// Value used Len() to get how many bytes is takes
+type Value = policy.Value
+
+// New is the constructor of Cache
+func New(maxBytes int64, onEvicted func(key string, value Value)) *Cache {
+	return &Cache{
+		maxBytes:  maxBytes,
+		cache:     make(map[string]*entry),
+		freqs:     make(map[int]*list.List),
+		OnEvicted: onEvicted,
+	}
+}
+
+// Add adds a value to the cache
+func (c *Cache) Add(key string, value Value) {
+	c.AddWithExpire(key, value, time.Time{})
+}
+
+// AddWithExpire adds a value to the cache which will be treated as
+// missing after expire, a zero expire means the value never expire
+func (c *Cache) AddWithExpire(key string, value Value, expire time.Time) {
+	c.RemoveExpired()
+	if e, ok := c.cache[key]; ok {
+		c.nBytes += int64(value.Len()) - int64(e.value.Len())
+		e.value = value
+		c.touch(e)
+	} else {
+		// make room first, the new entry would be the least frequent one
+		size := int64(value.Len()) + int64(len(key))
+		for c.maxBytes != 0 && len(c.cache) > 0 && c.maxBytes < c.nBytes+size {
+			c.RemoveLeastFrequent()
+		}
+		e := &entry{key: key, value: value, freq: 1}
+		e.ele = c.list(1).PushFront(e)
+		c.cache[key] = e
+		c.nBytes += size
+		c.minFreq = 1
+	}
+	c.expiries.Set(key, expire)
+	for c.maxBytes != 0 && c.maxBytes < c.nBytes {
+		c.RemoveLeastFrequent()
+	}
+}
+
+// Get look ups a key's value
+func (c *Cache) Get(key string) (value Value, ok bool) {
+	if e, ok := c.cache[key]; ok {
+		if c.expiries.Expired(key, time.Now()) {
+			c.removeEntry(e)
+			return nil, false
+		}
+		c.touch(e)
+		return e.value, true
+	}
+	return
+}
+
+// Remove removes the provided key from the cache
+func (c *Cache) Remove(key string) {
+	if e, ok := c.cache[key]; ok {
+		c.removeEntry(e)
+	}
+}
+
+// RemoveLeastFrequent remove the least frequently used item
+func (c *Cache) RemoveLeastFrequent() {
+	if len(c.cache) == 0 {
+		return
+	}
+	l, ok := c.freqs[c.minFreq]
+	if !ok {
+		// the minimum was removed out of order, look it up again
+		c.minFreq = 0
+		for freq := range c.freqs {
+			if c.minFreq == 0 || freq < c.minFreq {
+				c.minFreq = freq
+			}
+		}
+		l = c.freqs[c.minFreq]
+	}
+	c.removeEntry(l.Back().Value.(*entry))
+}
+
+// RemoveExpired remove all items whose deadline has passed
+func (c *Cache) RemoveExpired() {
+	now := time.Now()
+	for key, ok := c.expiries.Next(now); ok; key, ok = c.expiries.Next(now) {
+		c.Remove(key)
+	}
+}
+
+// Deadline return the deadline of key, zero if it has none
+func (c *Cache) Deadline(key string) time.Time {
+	return c.expiries.Deadline(key)
+}
+
+// Walk calls fn for every entry from the least to the most frequently used
+func (c *Cache) Walk(fn func(key string, value Value, expire time.Time)) {
+	freqs := make([]int, 0, len(c.freqs))
+	for freq := range c.freqs {
+		freqs = append(freqs, freq)
+	}
+	sort.Ints(freqs)
+	for _, freq := range freqs {
+		for ele := c.freqs[freq].Back(); ele != nil; ele = ele.Prev() {
+			e := ele.Value.(*entry)
+			fn(e.key, e.value, c.expiries.Deadline(e.key))
+		}
+	}
+}
+
+// Len return the number of cache entries
+func (c *Cache) Len() int {
+	return len(c.cache)
+}
+
+// Bytes return the number of bytes taken by keys and values
+func (c *Cache) Bytes() int64 {
+	return c.nBytes
+}
+
+func (c *Cache) list(freq int) *list.List {
+	l, ok := c.freqs[freq]
+	if !ok {
+		l = list.New()
+		c.freqs[freq] = l
+	}
+	return l
+}
+
+// touch moves e to the list of the next frequency
+func (c *Cache) touch(e *entry) {
+	c.unlink(e)
+	e.freq++
+	e.ele = c.list(e.freq).PushFront(e)
+}
+
+func (c *Cache) unlink(e *entry) {
+	l := c.freqs[e.freq]
+	l.Remove(e.ele)
+	if l.Len() == 0 {
+		delete(c.freqs, e.freq)
+		if c.minFreq == e.freq {
+			c.minFreq++
+		}
+	}
+}
+
+func (c *Cache) removeEntry(e *entry) {
+	c.unlink(e)
+	delete(c.cache, e.key)
+	c.expiries.Delete(e.key)
+	c.nBytes -= int64(len(e.key)) + int64(e.value.Len())
+	if c.OnEvicted != nil {
+		c.OnEvicted(e.key, e.value)
+	}
+}
+
+var _ policy.Policy = (*Cache)(nil)
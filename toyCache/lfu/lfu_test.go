@@ -0,0 +1,114 @@
+package lfu
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type String string
+
+func (d String) Len() int {
+	return len(d)
+}
+
+func TestCache_Get(t *testing.T) {
+	lfu := New(int64(0), nil)
+	lfu.Add("key1", String("123"))
+	if v, ok := lfu.Get("key1"); !ok || v.Len() != 3 {
+		t.Fatalf("cache hit key1=123 failed")
+	}
+	if _, ok := lfu.Get("key2"); ok {
+		t.Fatalf("cache miss key2 failed")
+	}
+}
+
+func TestCache_Add(t *testing.T) {
+	lfu := New(int64(0), nil)
+	lfu.Add("key", String("123"))
+	lfu.Add("key", String("1234"))
+	if lfu.nBytes != int64(len("key")+len("1234")) {
+		t.Fatal("expected 7 but got", lfu.nBytes)
+	}
+}
+
+func TestCache_RemoveLeastFrequent(t *testing.T) {
+	k1, k2, k3 := "key1", "key2", "key3"
+	v1, v2, v3 := "value1", "value2", "value3"
+	caps := len(k1 + v1 + k2 + v2)
+	lfu := New(int64(caps), nil)
+	lfu.Add(k1, String(v1))
+	lfu.Add(k2, String(v2))
+	// key1 is used more often, key2 should be evicted although it is more recent
+	lfu.Get(k1)
+	lfu.Add(k3, String(v3))
+
+	if _, ok := lfu.Get(k2); ok || lfu.Len() != 2 {
+		t.Fatalf("remove least frequent item key2=value2 failed")
+	}
+	if _, ok := lfu.Get(k1); !ok {
+		t.Fatalf("frequent item key1=value1 should be kept")
+	}
+}
+
+func TestCache_Remove(t *testing.T) {
+	lfu := New(int64(0), nil)
+	lfu.Add("key1", String("123"))
+	lfu.Add("key2", String("456"))
+	lfu.Get("key2")
+	lfu.Remove("key1")
+	lfu.RemoveLeastFrequent()
+	if lfu.Len() != 0 || lfu.nBytes != 0 {
+		t.Fatalf("remove all keys failed")
+	}
+}
+
+func TestCache_OnEvicted(t *testing.T) {
+	keys := make([]string, 0)
+	OnEvicted := func(key string, value Value) {
+		keys = append(keys, key)
+	}
+	lfu := New(int64(10), OnEvicted)
+
+	lfu.Add("key1", String("12345"))
+	lfu.Add("key2", String("12345"))
+	lfu.Add("key3", String("12345"))
+	expect := []string{"key1", "key2"}
+
+	if !reflect.DeepEqual(keys, expect) {
+		t.Fatalf("Called OnEvicted failed, expect keys %s, but got %s", expect, keys)
+	}
+}
+
+func TestCache_Expire(t *testing.T) {
+	lfu := New(int64(0), nil)
+	lfu.AddWithExpire("key1", String("123"), time.Now().Add(10*time.Millisecond))
+	lfu.Add("key2", String("456"))
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := lfu.Get("key1"); ok {
+		t.Fatalf("expired key1 should be a miss")
+	}
+	lfu.AddWithExpire("key3", String("789"), time.Now().Add(-time.Millisecond))
+	lfu.RemoveExpired()
+	if _, ok := lfu.Get("key2"); !ok || lfu.Len() != 1 {
+		t.Fatalf("key2 without deadline should not expire")
+	}
+}
+
+func TestCache_Walk(t *testing.T) {
+	lfu := New(int64(0), nil)
+	lfu.Add("k1", String("v1"))
+	lfu.Add("k2", String("v2"))
+	lfu.Add("k3", String("v3"))
+	lfu.Get("k1")
+	lfu.Get("k1")
+	lfu.Get("k3")
+
+	var keys []string
+	lfu.Walk(func(key string, value Value, expire time.Time) {
+		keys = append(keys, key)
+	})
+	if expect := []string{"k2", "k3", "k1"}; !reflect.DeepEqual(expect, keys) {
+		t.Fatalf("Walk order is %v, want %v", keys, expect)
+	}
+}
@@ -2,6 +2,8 @@ package lru
 
 import (
 	"container/list"
+	"github.com/toyCache/toyCache/policy"
+	"time"
 )
 
 // Cache is an LRU cache, it is not safe for concurrent access
@@ -10,6 +12,7 @@ type Cache struct {
 	nBytes   int64
 	ll       *list.List
 	cache    map[string]*list.Element
+	expiries policy.Expiries
 	// optional and executed when an entry is purged
 	OnEvicted func(key string, value Value)
 }
@@ -20,9 +23,7 @@ type entry struct {
 }
 
 // Value used Len() to get how many bytes is takes
-type Value interface {
-	Len() int
-}
+type Value = policy.Value
 
 // New is the constructor of Cache
 func New(maxBytes int64, onEvicted func(key string, value Value)) *Cache {
@@ -36,16 +37,24 @@ func New(maxBytes int64, onEvicted func(key string, value Value)) *Cache {
 
 // Add adds a value to the cache
 func (c *Cache) Add(key string, value Value) {
+	c.AddWithExpire(key, value, time.Time{})
+}
+
+// AddWithExpire adds a value to the cache which will be treated as
+// missing after expire, a zero expire means the value never expire
+func (c *Cache) AddWithExpire(key string, value Value, expire time.Time) {
+	c.RemoveExpired()
 	if ele, ok := c.cache[key]; ok {
 		kv := ele.Value.(*entry)
 		c.nBytes += int64(value.Len()) - int64(kv.value.Len())
 		c.ll.MoveToFront(ele)
 		kv.value = value
 	} else {
-		c.nBytes += int64(value.Len()) + int64(len(key))
 		ele := c.ll.PushFront(&entry{key: key, value: value})
+		c.nBytes += int64(value.Len()) + int64(len(key))
 		c.cache[key] = ele
 	}
+	c.expiries.Set(key, expire)
 	for c.maxBytes != 0 && c.maxBytes < c.nBytes {
 		c.RemoveOldest()
 	}
@@ -54,6 +63,10 @@ func (c *Cache) Add(key string, value Value) {
 // Get look ups a key's value
 func (c *Cache) Get(key string) (value Value, ok bool) {
 	if ele, ok := c.cache[key]; ok {
+		if c.expiries.Expired(key, time.Now()) {
+			c.removeElement(ele)
+			return nil, false
+		}
 		c.ll.MoveToFront(ele)
 		kv := ele.Value.(*entry)
 		return kv.value, true
@@ -61,17 +74,39 @@ func (c *Cache) Get(key string) (value Value, ok bool) {
 	return
 }
 
+// Remove removes the provided key from the cache
+func (c *Cache) Remove(key string) {
+	if ele, ok := c.cache[key]; ok {
+		c.removeElement(ele)
+	}
+}
+
 // RemoveOldest remove oldest item
 func (c *Cache) RemoveOldest() {
 	ele := c.ll.Back()
 	if ele != nil {
-		c.ll.Remove(ele)
+		c.removeElement(ele)
+	}
+}
+
+// RemoveExpired remove all items whose deadline has passed
+func (c *Cache) RemoveExpired() {
+	now := time.Now()
+	for key, ok := c.expiries.Next(now); ok; key, ok = c.expiries.Next(now) {
+		c.Remove(key)
+	}
+}
+
+// Deadline return the deadline of key, zero if it has none
+func (c *Cache) Deadline(key string) time.Time {
+	return c.expiries.Deadline(key)
+}
+
+// Walk calls fn for every entry from the least to the most recently used
+func (c *Cache) Walk(fn func(key string, value Value, expire time.Time)) {
+	for ele := c.ll.Back(); ele != nil; ele = ele.Prev() {
 		kv := ele.Value.(*entry)
-		delete(c.cache, kv.key)
-		c.nBytes -= int64(len(kv.key)) + int64(kv.value.Len())
-		if c.OnEvicted != nil {
-			c.OnEvicted(kv.key, kv.value)
-		}
+		fn(kv.key, kv.value, c.expiries.Deadline(kv.key))
 	}
 }
 
@@ -79,3 +114,21 @@ func (c *Cache) RemoveOldest() {
 func (c *Cache) Len() int {
 	return c.ll.Len()
 }
+
+// Bytes return the number of bytes taken by keys and values
+func (c *Cache) Bytes() int64 {
+	return c.nBytes
+}
+
+func (c *Cache) removeElement(ele *list.Element) {
+	c.ll.Remove(ele)
+	kv := ele.Value.(*entry)
+	delete(c.cache, kv.key)
+	c.expiries.Delete(kv.key)
+	c.nBytes -= int64(len(kv.key)) + int64(kv.value.Len())
+	if c.OnEvicted != nil {
+		c.OnEvicted(kv.key, kv.value)
+	}
+}
+
+var _ policy.Policy = (*Cache)(nil)
@@ -2,7 +2,10 @@ package lru
 
 import (
 	"reflect"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 type String string
@@ -31,6 +34,17 @@ func TestCache_Add(t *testing.T) {
 	}
 }
 
+func TestCache_Remove(t *testing.T) {
+	lru := New(int64(0), nil)
+	lru.Add("key1", String("123"))
+	lru.Add("key2", String("456"))
+	lru.Remove("key1")
+	lru.Remove("key3")
+	if _, ok := lru.Get("key1"); ok || lru.Len() != 1 || lru.nBytes != int64(len("key2")+3) {
+		t.Fatalf("remove key1 failed")
+	}
+}
+
 func TestCache_RemoveOldest(t *testing.T) {
 	k1, k2, k3 := "key1", "key2", "key3"
 	v1, v2, v3 := "value1", "value2", "value3"
@@ -60,4 +74,110 @@ func TestCache_OnEvicted(t *testing.T) {
 	if !reflect.DeepEqual(keys, expect) {
 		t.Fatalf("Called OnEvicted failed, expect keys %s, but got %s", expect, keys)
 	}
-}
\ No newline at end of file
+}
+
+func TestCache_Expire(t *testing.T) {
+	lru := New(int64(0), nil)
+	lru.AddWithExpire("key1", String("123"), time.Now().Add(10*time.Millisecond))
+	lru.Add("key2", String("456"))
+	if _, ok := lru.Get("key1"); !ok {
+		t.Fatalf("cache hit key1 before expire failed")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := lru.Get("key1"); ok {
+		t.Fatalf("expired key1 should be a miss")
+	}
+	if _, ok := lru.Get("key2"); !ok || lru.Len() != 1 {
+		t.Fatalf("key2 without deadline should not expire")
+	}
+}
+
+func TestCache_RemoveExpired(t *testing.T) {
+	keys := make([]string, 0)
+	OnEvicted := func(key string, value Value) {
+		keys = append(keys, key)
+	}
+	lru := New(int64(0), OnEvicted)
+	lru.AddWithExpire("key1", String("1"), time.Now().Add(10*time.Millisecond))
+	lru.AddWithExpire("key2", String("2"), time.Now().Add(time.Hour))
+	lru.AddWithExpire("key3", String("3"), time.Now().Add(5*time.Millisecond))
+	// reset deadline of key2 so it never expire
+	lru.Add("key2", String("2"))
+	time.Sleep(20 * time.Millisecond)
+
+	lru.RemoveExpired()
+	expect := []string{"key3", "key1"}
+	if !reflect.DeepEqual(keys, expect) || lru.Len() != 1 || lru.nBytes != int64(len("key2")+1) {
+		t.Fatalf("RemoveExpired failed, expect evicted keys %s, but got %s", expect, keys)
+	}
+}
+
+func TestCache_Walk(t *testing.T) {
+	lru := New(int64(0), nil)
+	expire := time.Now().Add(time.Hour)
+	lru.Add("k1", String("v1"))
+	lru.AddWithExpire("k2", String("v2"), expire)
+	lru.Add("k3", String("v3"))
+	lru.Get("k1")
+
+	var keys []string
+	lru.Walk(func(key string, value Value, exp time.Time) {
+		keys = append(keys, key)
+		if key == "k2" && !exp.Equal(expire) {
+			t.Fatalf("deadline of k2 is %v, want %v", exp, expire)
+		}
+		if key != "k2" && !exp.IsZero() {
+			t.Fatalf("%s should have no deadline", key)
+		}
+	})
+	if expect := []string{"k2", "k3", "k1"}; !reflect.DeepEqual(expect, keys) {
+		t.Fatalf("Walk order is %v, want %v", keys, expect)
+	}
+}
+
+func BenchmarkCache_Get(b *testing.B) {
+	lru := New(int64(0), nil)
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+		lru.Add(keys[i], String("value"))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lru.Get(keys[i%len(keys)])
+	}
+}
+
+func BenchmarkCache_GetParallel(b *testing.B) {
+	// Cache is not safe for concurrent access, a mutex is the baseline
+	// that sharded caches in toyCache are compared to
+	var mu sync.Mutex
+	lru := New(int64(0), nil)
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+		lru.Add(keys[i], String("value"))
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			mu.Lock()
+			lru.Get(keys[i%len(keys)])
+			mu.Unlock()
+			i++
+		}
+	})
+}
+
+func BenchmarkCache_Add(b *testing.B) {
+	lru := New(int64(64<<10), nil)
+	keys := make([]string, 4096)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lru.Add(keys[i%len(keys)], String("value"))
+	}
+}
@@ -0,0 +1,197 @@
+package toyCache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const defaultMetricsPath = "/metrics"
+
+// latencyBuckets are the upper bounds in seconds of peer request histograms
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// histogram counts observed durations into latencyBuckets,
+// it is safe for concurrent use
+type histogram struct {
+	counts []uint64 // counts[i] observations <= latencyBuckets[i], the last one is +Inf
+	count  uint64
+	sum    int64 // nanoseconds
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.SearchFloat64s(latencyBuckets, d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// ServeMetrics write the stats of every registered group and the peer
+// request latencies of the pool in Prometheus text exposition format
+func (h *HTTPPool) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	writeGroupMetrics(bw, sortedGroups())
+	ring := h.loadRing()
+	getters := make(map[string]*histogram, len(ring.httpGetter))
+	for peer, getter := range ring.httpGetter {
+		getters[peer] = getter.latency
+	}
+	writeLatencyMetrics(bw, getters)
+	bw.Flush()
+}
+
+func sortedGroups() []*Group {
+	mu.RLock()
+	list := make([]*Group, 0, len(groups))
+	for _, g := range groups {
+		list = append(list, g)
+	}
+	mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].name < list[j].name
+	})
+	return list
+}
+
+type groupMetric struct {
+	name  string
+	kind  string // counter or gauge
+	help  string
+	value func(s *Stats) float64
+}
+
+var groupMetrics = []groupMetric{
+	{"toycache_gets_total", "counter", "Get requests, including from peers.",
+		func(s *Stats) float64 { return float64(s.Gets) }},
+	{"toycache_cache_hits_total", "counter", "Get requests served from either cache.",
+		func(s *Stats) float64 { return float64(s.CacheHits) }},
+	{"toycache_hit_ratio", "gauge", "Ratio of cache hits to get requests.",
+		func(s *Stats) float64 { return ratio(s.CacheHits, s.Gets) }},
+	{"toycache_negative_hits_total", "counter", "Get requests failed with the error of a recent load.",
+		func(s *Stats) float64 { return float64(s.NegativeHits) }},
+	{"toycache_stale_hits_total", "counter", "Get requests served a value past its soft TTL.",
+		func(s *Stats) float64 { return float64(s.StaleHits) }},
+	{"toycache_refreshes_total", "counter", "Background reloads of stale or expiring values.",
+		func(s *Stats) float64 { return float64(s.Refreshes) }},
+	{"toycache_stale_serves_total", "counter", "Failed loads answered with a stale value.",
+		func(s *Stats) float64 { return float64(s.StaleServes) }},
+	{"toycache_ring_disagreements_total", "counter", "Requests forwarded by a peer for keys this peer does not own.",
+		func(s *Stats) float64 { return float64(s.RingDisagreements) }},
+	{"toycache_fallback_loads_total", "counter", "Loads served by the successor of a failed owner.",
+		func(s *Stats) float64 { return float64(s.FallbackLoads) }},
+	{"toycache_loads_total", "counter", "Cache misses that triggered a load.",
+		func(s *Stats) float64 { return float64(s.Loads) }},
+	{"toycache_loads_deduped_total", "counter", "Loads left after singleflight.",
+		func(s *Stats) float64 { return float64(s.LoadsDeduped) }},
+	{"toycache_peer_loads_total", "counter", "Values loaded from peers.",
+		func(s *Stats) float64 { return float64(s.PeerLoads) }},
+	{"toycache_peer_errors_total", "counter", "Failed loads from peers.",
+		func(s *Stats) float64 { return float64(s.PeerErrors) }},
+	{"toycache_local_loads_total", "counter", "Values loaded by the local getter.",
+		func(s *Stats) float64 { return float64(s.LocalLoads) }},
+	{"toycache_local_load_errors_total", "counter", "Failed loads by the local getter.",
+		func(s *Stats) float64 { return float64(s.LocalLoadErrs) }},
+	{"toycache_server_requests_total", "counter", "Get requests that came from peers.",
+		func(s *Stats) float64 { return float64(s.ServerRequests) }},
+}
+
+type cacheMetric struct {
+	name  string
+	kind  string
+	help  string
+	value func(s *CacheStats) float64
+}
+
+var cacheMetrics = []cacheMetric{
+	{"toycache_cache_bytes", "gauge", "Bytes of keys and values held in the cache.",
+		func(s *CacheStats) float64 { return float64(s.Bytes) }},
+	{"toycache_cache_items", "gauge", "Items held in the cache.",
+		func(s *CacheStats) float64 { return float64(s.Items) }},
+	{"toycache_cache_lookups_total", "counter", "Lookups in the cache.",
+		func(s *CacheStats) float64 { return float64(s.Gets) }},
+	{"toycache_cache_lookup_hits_total", "counter", "Lookups found in the cache.",
+		func(s *CacheStats) float64 { return float64(s.Hits) }},
+	{"toycache_cache_evictions_total", "counter", "Items evicted from the cache.",
+		func(s *CacheStats) float64 { return float64(s.Evictions) }},
+	{"toycache_cache_disk_hits_total", "counter", "Lookups found in the disk tier.",
+		func(s *CacheStats) float64 { return float64(s.DiskHits) }},
+	{"toycache_cache_disk_bytes", "gauge", "Bytes of the disk tier files.",
+		func(s *CacheStats) float64 { return float64(s.DiskBytes) }},
+	{"toycache_cache_disk_items", "gauge", "Items held in the disk tier.",
+		func(s *CacheStats) float64 { return float64(s.DiskItems) }},
+}
+
+func writeGroupMetrics(w io.Writer, list []*Group) {
+	stats := make([]Stats, len(list))
+	for i, g := range list {
+		stats[i] = g.Stats()
+	}
+	for _, m := range groupMetrics {
+		writeHeader(w, m.name, m.kind, m.help)
+		for i, g := range list {
+			fmt.Fprintf(w, "%s{group=\"%s\"} %s\n", m.name, escapeLabel(g.name), formatFloat(m.value(&stats[i])))
+		}
+	}
+	for _, m := range cacheMetrics {
+		writeHeader(w, m.name, m.kind, m.help)
+		for i, g := range list {
+			fmt.Fprintf(w, "%s{group=\"%s\",cache=\"main\"} %s\n", m.name, escapeLabel(g.name), formatFloat(m.value(&stats[i].MainCache)))
+			fmt.Fprintf(w, "%s{group=\"%s\",cache=\"hot\"} %s\n", m.name, escapeLabel(g.name), formatFloat(m.value(&stats[i].HotCache)))
+		}
+	}
+}
+
+func writeLatencyMetrics(w io.Writer, peers map[string]*histogram) {
+	const name = "toycache_peer_request_duration_seconds"
+	names := make([]string, 0, len(peers))
+	for peer := range peers {
+		names = append(names, peer)
+	}
+	sort.Strings(names)
+
+	writeHeader(w, name, "histogram", "Latency of requests sent to peers.")
+	for _, peer := range names {
+		h, label := peers[peer], escapeLabel(peer)
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			fmt.Fprintf(w, "%s_bucket{peer=\"%s\",le=\"%s\"} %d\n", name, label, formatFloat(le), cumulative)
+		}
+		count := atomic.LoadUint64(&h.count)
+		fmt.Fprintf(w, "%s_bucket{peer=\"%s\",le=\"+Inf\"} %d\n", name, label, count)
+		fmt.Fprintf(w, "%s_sum{peer=\"%s\"} %s\n", name, label, formatFloat(time.Duration(atomic.LoadInt64(&h.sum)).Seconds()))
+		fmt.Fprintf(w, "%s_count{peer=\"%s\"} %d\n", name, label, count)
+	}
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func ratio(n, d int64) float64 {
+	if d == 0 {
+		return 0
+	}
+	return float64(n) / float64(d)
+}
@@ -0,0 +1,389 @@
+package toyCache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/toyCache/toyCache/singleflight"
+	pb "github.com/toyCache/toyCache/toycachepb"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BatchGetter is optionally implemented by a Getter to load many keys
+// at once, keys missing from the returned map were not found
+type BatchGetter interface {
+	GetMulti(ctx context.Context, keys []string) (map[string][]byte, error)
+}
+
+// MultiError holds the keys of a GetMulti call that failed
+// with an error other than ErrNotFound
+type MultiError map[string]error
+
+func (m MultiError) Error() string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	msgs := make([]string, len(keys))
+	for i, key := range keys {
+		msgs[i] = fmt.Sprintf("%s: %v", key, m[key])
+	}
+	return fmt.Sprintf("toyCache: %d keys failed: %s", len(m), strings.Join(msgs, "; "))
+}
+
+// multiResult collects the outcome of a GetMulti call
+type multiResult struct {
+	mu     sync.Mutex
+	values map[string]ByteView
+	errs   MultiError
+	stale  map[string]bool // keys of the stale values served
+}
+
+func (r *multiResult) set(key string, value ByteView) {
+	r.mu.Lock()
+	r.values[key] = value
+	r.mu.Unlock()
+}
+
+func (r *multiResult) setStale(key string, value ByteView) {
+	r.mu.Lock()
+	r.values[key] = value
+	r.stale[key] = true
+	r.mu.Unlock()
+}
+
+func (r *multiResult) fail(key string, err error) {
+	if errors.Is(err, ErrNotFound) {
+		return
+	}
+	r.mu.Lock()
+	r.errs[key] = err
+	r.mu.Unlock()
+}
+
+// result return what was loaded for key, a key neither set
+// nor failed was not found
+func (r *multiResult) result(key string) (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if value, ok := r.values[key]; ok {
+		return value, nil
+	}
+	if err, ok := r.errs[key]; ok {
+		return nil, err
+	}
+	return nil, ErrNotFound
+}
+
+func newMultiResult(n int) *multiResult {
+	return &multiResult{
+		values: make(map[string]ByteView, n),
+		errs:   make(MultiError),
+		stale:  make(map[string]bool),
+	}
+}
+
+func (r *multiResult) err() error {
+	if len(r.errs) > 0 {
+		return r.errs
+	}
+	return nil
+}
+
+// GetMulti return the values of keys, the misses are fetched with one
+// request per owning peer and one BatchGetter call for the local ones.
+// Keys not found are missing from the map, if other keys failed the
+// values found are returned along with a MultiError. Stale values
+// served by WithStaleIfError are returned like fresh ones
+func (g *Group) GetMulti(ctx context.Context, keys []string) (map[string]ByteView, error) {
+	res := g.getMulti(ctx, keys)
+	return res.values, res.err()
+}
+
+// GetMultiWithStale is GetMulti that also return the keys whose
+// value is stale, see WithStaleIfError
+func (g *Group) GetMultiWithStale(ctx context.Context, keys []string) (values map[string]ByteView, stale map[string]bool, err error) {
+	res := g.getMulti(ctx, keys)
+	return res.values, res.stale, res.err()
+}
+
+func (g *Group) getMulti(ctx context.Context, keys []string) *multiResult {
+	res := newMultiResult(len(keys))
+	var misses []string
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		g.stats.gets.Add(1)
+		if v, ok := g.lookupCache(key); ok {
+			res.values[key] = v
+			continue
+		}
+		if err, ok := g.lookupNegative(key); ok {
+			g.getMultiStale(key, err, res)
+			continue
+		}
+		misses = append(misses, key)
+	}
+	if len(misses) > 0 {
+		g.loadMulti(ctx, misses, res)
+	}
+	return res
+}
+
+// loadMulti is load for many keys. Each miss joins the load in flight
+// for its key, the keys this call leads are loaded in one batch
+func (g *Group) loadMulti(ctx context.Context, keys []string, res *multiResult) {
+	if err := ctx.Err(); err != nil {
+		for _, key := range keys {
+			res.fail(key, err)
+		}
+		return
+	}
+	g.stats.loads.Add(int64(len(keys)))
+	batch := newMultiResult(len(keys))
+	done := make(chan struct{})
+	chans := make(map[string]<-chan singleflight.Result, len(keys))
+	var lead []string
+	for _, key := range keys {
+		key := key
+		ch, leader := g.loadGroup.DoChanLeader(key, func() (interface{}, error) {
+			g.stats.loadsDeduped.Add(1)
+			<-done
+			return batch.result(key)
+		})
+		chans[key] = ch
+		if leader {
+			lead = append(lead, key)
+		}
+	}
+	go func() {
+		defer close(done)
+		if len(lead) == 0 {
+			return
+		}
+		loadCtx, cancel := context.WithTimeout(detachedContext{ctx}, g.loadTimeout)
+		defer cancel()
+		g.loadMultiShared(loadCtx, lead, batch)
+	}()
+
+	for _, key := range keys {
+		select {
+		case r := <-chans[key]:
+			if r.Err != nil {
+				g.getMultiStale(key, r.Err, res)
+				continue
+			}
+			res.set(key, r.Val.(ByteView))
+		case <-ctx.Done():
+			res.fail(key, ctx.Err())
+		}
+	}
+}
+
+// loadMultiShared is loadShared for a batch of keys, replicated keys
+// are loaded one by one and the others grouped by owner
+func (g *Group) loadMultiShared(ctx context.Context, keys []string, res *multiResult) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var local []string
+	byPeer := make(map[PeerGetter][]string)
+	for _, key := range keys {
+		if replicas := g.replicas(key); len(replicas) > 0 {
+			wg.Add(1)
+			go func(key string, replicas []PeerGetter) {
+				defer wg.Done()
+				value, err := g.loadFromReplicas(ctx, key, replicas)
+				if err != nil {
+					res.fail(key, err)
+					return
+				}
+				res.set(key, value)
+			}(key, replicas)
+			continue
+		}
+		if peer, ok := g.pickPeer(ctx, key); ok {
+			byPeer[peer] = append(byPeer[peer], key)
+			continue
+		}
+		local = append(local, key)
+	}
+	for peer, keys := range byPeer {
+		wg.Add(1)
+		go func(peer PeerGetter, keys []string) {
+			defer wg.Done()
+			failed, unreachable := g.getMultiFromPeer(ctx, peer, keys, res)
+			failed = append(failed, g.getMultiFromFallback(ctx, unreachable, peer, res)...)
+			mu.Lock()
+			local = append(local, failed...)
+			mu.Unlock()
+		}(peer, keys)
+	}
+	wg.Wait()
+	// keys of an ejected owner go to its successor too
+	local = g.getMultiFromFallback(ctx, local, nil, res)
+	g.getMultiLocally(ctx, local, res)
+}
+
+// getMultiFromFallback ask the successors of keys whose owner failed,
+// and return the keys left to the local Getter
+func (g *Group) getMultiFromFallback(ctx context.Context, keys []string, owner PeerGetter, res *multiResult) []string {
+	var local []string
+	for _, key := range keys {
+		value, ok, err := g.loadFromFallback(ctx, key, owner)
+		if !ok {
+			local = append(local, key)
+			continue
+		}
+		if err != nil {
+			res.fail(key, err)
+			continue
+		}
+		res.set(key, value)
+	}
+	return local
+}
+
+// getMultiStale record err for key, or the stale value served in its place
+func (g *Group) getMultiStale(key string, err error, res *multiResult) {
+	value, _, err := g.serveStale(key, err)
+	if err != nil {
+		res.fail(key, err)
+		return
+	}
+	res.setStale(key, value)
+}
+
+// getMultiFromPeer return the keys the peer failed to serve, they are
+// loaded locally like a failed Get. The keys of an unreachable peer
+// are returned apart, their successor is asked first
+func (g *Group) getMultiFromPeer(ctx context.Context, peer PeerGetter, keys []string, res *multiResult) (failed, unreachable []string) {
+	bp, ok := peer.(BatchPeerGetter)
+	if !ok {
+		for _, key := range keys {
+			value, err := g.getFromPeer(ctx, peer, key)
+			if err == nil {
+				g.stats.peerLoads.Add(1)
+				res.set(key, value)
+				continue
+			}
+			if errors.Is(err, ErrNotFound) {
+				g.stats.peerLoads.Add(1)
+				g.populateNegative(key, err)
+				continue
+			}
+			g.stats.peerErrors.Add(1)
+			if ownerUnreachable(err) {
+				unreachable = append(unreachable, key)
+				continue
+			}
+			failed = append(failed, key)
+		}
+		return failed, unreachable
+	}
+
+	out := &pb.MultiResponse{}
+	err := bp.GetMulti(ctx, &pb.MultiRequest{Group: g.name, Keys: keys, Forwarded: true}, out)
+	if err != nil {
+		g.stats.peerErrors.Add(int64(len(keys)))
+		log.Println("[toyCache] Failed to get multi from peer", err)
+		if ownerUnreachable(err) {
+			return nil, keys
+		}
+		return keys, nil
+	}
+	stale := make(map[string]bool, len(out.Stale))
+	for _, key := range out.Stale {
+		stale[key] = true
+	}
+	for _, key := range keys {
+		if b, ok := out.Values[key]; ok && stale[key] {
+			// like a stale Get answer, keep it in case the local
+			// Getter fails too
+			g.stats.peerErrors.Add(1)
+			if g.staleCache != nil {
+				g.staleCache.add(key, ByteView{b: b}, time.Now().Add(g.staleGrace))
+			}
+			failed = append(failed, key)
+		} else if ok {
+			g.stats.peerLoads.Add(1)
+			value := ByteView{b: b}
+			g.populateHotCache(key, value)
+			res.set(key, value)
+		} else if _, ok := out.Errors[key]; ok {
+			// the peer answered, its load failed
+			g.stats.peerErrors.Add(1)
+			failed = append(failed, key)
+		} else {
+			g.stats.peerLoads.Add(1)
+			g.populateNegative(key, ErrNotFound)
+		}
+	}
+	return failed, nil
+}
+
+func (g *Group) getMultiLocally(ctx context.Context, keys []string, res *multiResult) {
+	if len(keys) == 0 {
+		return
+	}
+	bg, ok := g.getter.(BatchGetter)
+	if !ok {
+		for _, key := range keys {
+			value, err := g.getLocally(ctx, key)
+			if err != nil {
+				g.populateNegative(key, err)
+				res.fail(key, err)
+				continue
+			}
+			res.set(key, value)
+		}
+		return
+	}
+
+	values, err := bg.GetMulti(ctx, keys)
+	if err != nil {
+		g.stats.localLoadErrs.Add(int64(len(keys)))
+		for _, key := range keys {
+			g.populateNegative(key, err)
+			res.fail(key, err)
+		}
+		return
+	}
+	for _, key := range keys {
+		b, ok := values[key]
+		if !ok {
+			g.stats.localLoadErrs.Add(1)
+			g.populateNegative(key, ErrNotFound)
+			continue
+		}
+		g.stats.localLoads.Add(1)
+		value := ByteView{b: cloneBytes(b)}
+		g.populateCache(key, value, g.mainCache, g.ttl)
+		res.set(key, value)
+	}
+}
+
+// multiResponse encode the outcome of GetMulti for a peer
+func multiResponse(res *multiResult) *pb.MultiResponse {
+	out := &pb.MultiResponse{Values: make(map[string][]byte, len(res.values))}
+	for key, value := range res.values {
+		out.Values[key] = value.b
+	}
+	if len(res.errs) > 0 {
+		out.Errors = make(map[string]string, len(res.errs))
+		for key, err := range res.errs {
+			out.Errors[key] = err.Error()
+		}
+	}
+	for key := range res.stale {
+		out.Stale = append(out.Stale, key)
+	}
+	return out
+}
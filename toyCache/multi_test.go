@@ -0,0 +1,198 @@
+package toyCache
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	pb "github.com/toyCache/toyCache/toycachepb"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+type batchGetter struct {
+	calls [][]string
+}
+
+func (b *batchGetter) Get(_ context.Context, key string, dest Sink) error {
+	return errors.New("Get should not be called")
+}
+
+func (b *batchGetter) GetMulti(_ context.Context, keys []string) (map[string][]byte, error) {
+	b.calls = append(b.calls, keys)
+	values := make(map[string][]byte)
+	for _, key := range keys {
+		if v, ok := db[key]; ok {
+			values[key] = []byte(v)
+		}
+	}
+	return values, nil
+}
+
+func TestGetMultiLocal(t *testing.T) {
+	getter := &batchGetter{}
+	toyC := NewGroup("multiLocal", 2<<10, getter, WithNegativeCache(time.Minute, 0))
+	ctx := context.Background()
+
+	values, err := toyC.GetMulti(ctx, []string{"Tom", "Bob", "Unknown", "Tom"})
+	require.NoError(t, err)
+	require.Len(t, values, 2)
+	require.Equal(t, "630", values["Tom"].String())
+	require.Equal(t, "123", values["Bob"].String())
+	require.Len(t, getter.calls, 1, "misses should be loaded in one call")
+
+	values, err = toyC.GetMulti(ctx, []string{"Tom", "Jack", "Unknown"})
+	require.NoError(t, err)
+	require.Len(t, values, 2)
+	require.Equal(t, [][]string{{"Tom", "Bob", "Unknown"}, {"Jack"}}, getter.calls,
+		"hits and remembered not found keys should not be loaded")
+}
+
+func TestGetMultiError(t *testing.T) {
+	toyC := NewGroup("multiError", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		switch key {
+		case "down":
+			return nil, errors.New("db is down")
+		case "Unknown":
+			return nil, ErrNotFound
+		}
+		return []byte(key), nil
+	}))
+	values, err := toyC.GetMulti(context.Background(), []string{"Tom", "down", "Unknown"})
+	require.Len(t, values, 1)
+	var merr MultiError
+	require.ErrorAs(t, err, &merr)
+	require.Len(t, merr, 1)
+	require.EqualError(t, merr["down"], "db is down")
+}
+
+type batchPeer struct {
+	testPeer
+	batches [][]string
+}
+
+func (p *batchPeer) GetMulti(_ context.Context, in *pb.MultiRequest, out *pb.MultiResponse) error {
+	p.batches = append(p.batches, in.Keys)
+	out.Values = make(map[string][]byte)
+	for _, key := range in.Keys {
+		if key != "Unknown" {
+			out.Values[key] = []byte("peer:" + key)
+		}
+	}
+	return nil
+}
+
+type keyPicker map[string]PeerGetter
+
+func (p keyPicker) PickPeer(key string) (PeerGetter, bool) {
+	peer, ok := p[key]
+	return peer, ok
+}
+
+func TestGetMultiPeers(t *testing.T) {
+	toyC := NewGroup("multiPeers", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte("local:" + key), nil
+	}))
+	peer1, peer2 := &batchPeer{}, &testPeer{}
+	toyC.RegisterPeer(keyPicker{"a": peer1, "b": peer1, "Unknown": peer1, "c": peer2})
+
+	values, err := toyC.GetMulti(context.Background(), []string{"a", "b", "c", "d", "Unknown"})
+	require.NoError(t, err)
+	require.Equal(t, "peer:a", values["a"].String())
+	require.Equal(t, "peer:b", values["b"].String())
+	require.Equal(t, "peer:c", values["c"].String())
+	require.Equal(t, "local:d", values["d"].String())
+	require.NotContains(t, values, "Unknown")
+
+	require.Len(t, peer1.batches, 1, "keys of a peer should be sent in one request")
+	sort.Strings(peer1.batches[0])
+	require.Equal(t, []string{"Unknown", "a", "b"}, peer1.batches[0])
+	require.Equal(t, 1, peer2.gets, "peers without GetMulti should get one request per key")
+}
+
+func TestGetMultiDedup(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	loads := make(map[string]int)
+	toyC := NewGroup("multiDedup", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		mu.Lock()
+		loads[key]++
+		mu.Unlock()
+		if key == "Tom" {
+			<-release
+		}
+		return []byte(key), nil
+	}))
+	ctx := context.Background()
+
+	got := make(chan error, 1)
+	go func() {
+		_, err := getView(toyC, ctx, "Tom")
+		got <- err
+	}()
+	require.Eventually(t, func() bool { return toyC.Stats().LoadsDeduped == 1 }, time.Second, time.Millisecond)
+
+	multi := make(chan map[string]ByteView, 1)
+	go func() {
+		values, err := toyC.GetMulti(ctx, []string{"Tom", "Bob"})
+		require.NoError(t, err)
+		multi <- values
+	}()
+	require.Eventually(t, func() bool { return toyC.Stats().LoadsDeduped == 2 }, time.Second, time.Millisecond)
+	close(release)
+
+	require.NoError(t, <-got)
+	values := <-multi
+	require.Equal(t, "Tom", values["Tom"].String())
+	require.Equal(t, "Bob", values["Bob"].String())
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, map[string]int{"Tom": 1, "Bob": 1}, loads, "a miss loading already should be joined")
+}
+
+func TestGetMultiRouting(t *testing.T) {
+	loads := 0
+	toyC := NewGroup("multiRouting", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}), WithFallback(FallbackSuccessor))
+	owner, successor := &replicaPeer{down: true}, &replicaPeer{}
+	toyC.RegisterPeer(fallbackPicker{owner: owner, fallback: successor})
+
+	values, err := toyC.GetMulti(context.Background(), []string{"Tom", "Bob"})
+	require.NoError(t, err)
+	require.Equal(t, "replica:Tom", values["Tom"].String())
+	require.Equal(t, "replica:Bob", values["Bob"].String())
+	require.Equal(t, 0, loads, "keys of a failed owner should go to its successor")
+
+	replicated := NewGroup("multiReplicas", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}))
+	primary, secondary := &replicaPeer{down: true}, &replicaPeer{}
+	replicated.RegisterPeer(replicaPicker{primary, secondary})
+	values, err = replicated.GetMulti(context.Background(), []string{"Tom"})
+	require.NoError(t, err)
+	require.Equal(t, "replica:Tom", values["Tom"].String(), "replicated keys should be asked to the next replica")
+	require.Equal(t, 0, loads)
+}
+
+func TestGetMultiStale(t *testing.T) {
+	down := false
+	toyC := NewGroup("multiStale", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		if down {
+			return nil, errors.New("db is down")
+		}
+		return []byte(key), nil
+	}), WithTTL(10*time.Millisecond), WithStaleIfError(time.Minute))
+	ctx := context.Background()
+
+	_, err := toyC.GetMulti(ctx, []string{"Tom"})
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	down = true
+	values, err := toyC.GetMulti(ctx, []string{"Tom"})
+	require.NoError(t, err)
+	require.Equal(t, "Tom", values["Tom"].String(), "stale value should be served when the load fails")
+}
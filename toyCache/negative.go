@@ -0,0 +1,95 @@
+package toyCache
+
+import (
+	"context"
+	"errors"
+	"github.com/toyCache/toyCache/lru"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned, possibly wrapped, by a Getter when the key
+// does not exist in the backing store. Unlike other errors it is
+// reported to peers as not found instead of as a failure
+var ErrNotFound = errors.New("toyCache: key not found")
+
+// negativeCacheRatio is the part of the group cacheBytes given to
+// the negative cache
+const negativeCacheRatio = 16
+
+// negativeCache remembers the keys whose load failed for a short time
+// so that missing keys don't hammer the Getter
+type negativeCache struct {
+	mu  sync.Mutex
+	lru *lru.Cache
+}
+
+type negativeEntry struct {
+	err error
+}
+
+func (e negativeEntry) Len() int {
+	return len(e.err.Error())
+}
+
+func newNegativeCache(cacheBytes int64) *negativeCache {
+	return &negativeCache{lru: lru.New(cacheBytes, nil)}
+}
+
+func (c *negativeCache) add(key string, err error, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.AddWithExpire(key, negativeEntry{err: err}, time.Now().Add(ttl))
+}
+
+func (c *negativeCache) get(key string) (error, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.lru.Get(key); ok {
+		return v.(negativeEntry).err, true
+	}
+	return nil, false
+}
+
+func (c *negativeCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Remove(key)
+}
+
+// WithNegativeCache make the group remember for notFoundTTL the keys whose
+// load failed with ErrNotFound, and for errTTL the keys whose load failed
+// with any other error. A zero ttl disables that kind of negative caching
+func WithNegativeCache(notFoundTTL, errTTL time.Duration) GroupOption {
+	return func(g *Group) {
+		g.notFoundTTL = notFoundTTL
+		g.errTTL = errTTL
+	}
+}
+
+// lookupNegative return the error of a recent failed load of key
+func (g *Group) lookupNegative(key string) (error, bool) {
+	if g.negCache == nil {
+		return nil, false
+	}
+	err, ok := g.negCache.get(key)
+	if ok {
+		g.stats.negativeHits.Add(1)
+	}
+	return err, ok
+}
+
+// populateNegative remember that the load of key failed with err,
+// a load cancelled or timed out says nothing about the key
+func (g *Group) populateNegative(key string, err error) {
+	if g.negCache == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	ttl := g.errTTL
+	if errors.Is(err, ErrNotFound) {
+		ttl = g.notFoundTTL
+	}
+	if ttl > 0 {
+		g.negCache.add(key, err, ttl)
+	}
+}
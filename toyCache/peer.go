@@ -1,10 +1,16 @@
 package toyCache
 
-import pb "github.com/toyCache/toyCache/toycachepb"
+import (
+	"context"
+	pb "github.com/toyCache/toyCache/toycachepb"
+	"log"
+)
 
 // PeerGetter is an interface must be implemented by a peer.
 type PeerGetter interface {
-	Get(in *pb.Request, out *pb.Response) error
+	Get(ctx context.Context, in *pb.Request, out *pb.Response) error
+	Delete(ctx context.Context, in *pb.Request, out *pb.DeleteResponse) error
+	Set(ctx context.Context, in *pb.SetRequest, out *pb.SetResponse) error
 }
 
 // PeerPicker is an interface must be implemented to locate the peer
@@ -12,3 +18,91 @@ type PeerGetter interface {
 type PeerPicker interface {
 	PickPeer(key string) (peer PeerGetter, ok bool)
 }
+
+// ReplicaPicker is optionally implemented by a PeerPicker that stores
+// each key on several peers
+type ReplicaPicker interface {
+	// PickReplicas return the peers holding key, primary first, where
+	// a nil PeerGetter stands for the local peer. It return nothing
+	// when keys are not replicated
+	PickReplicas(key string) []PeerGetter
+}
+
+// FallbackPicker is optionally implemented by a PeerPicker to pick the
+// peer loading a key in place of its failed owner
+type FallbackPicker interface {
+	// PickFallback return the first live peer after the owner of key
+	// on the ring, where a nil PeerGetter stands for the local peer.
+	// ok is false when the local peer owns key or no other peer is left
+	PickFallback(key string) (peer PeerGetter, ok bool)
+}
+
+// BatchPeerGetter is optionally implemented by a PeerGetter
+// to fetch many keys in one request
+type BatchPeerGetter interface {
+	GetMulti(ctx context.Context, in *pb.MultiRequest, out *pb.MultiResponse) error
+}
+
+type forwardedKey struct{}
+
+// forwardKind tells why a peer forwarded a request
+type forwardKind int
+
+const (
+	// forwardOwner is sent to the owner of the key
+	forwardOwner forwardKind = iota
+	// forwardFallback is sent in place of the failed owner
+	forwardFallback
+	// forwardBounded is sent in place of an overloaded owner, see LoadBound
+	forwardBounded
+)
+
+// forwardKindOf return the kind of a forwarded request from its flags
+func forwardKindOf(fallback, bounded bool) forwardKind {
+	switch {
+	case fallback:
+		return forwardFallback
+	case bounded:
+		return forwardBounded
+	}
+	return forwardOwner
+}
+
+// withForwarded mark ctx as serving a request forwarded by a peer,
+// such a request is served locally and never forwarded again
+func withForwarded(ctx context.Context, kind forwardKind) context.Context {
+	return context.WithValue(ctx, forwardedKey{}, kind)
+}
+
+func isForwarded(ctx context.Context) bool {
+	_, forwarded := ctx.Value(forwardedKey{}).(forwardKind)
+	return forwarded
+}
+
+func forwardedKind(ctx context.Context) forwardKind {
+	kind, _ := ctx.Value(forwardedKey{}).(forwardKind)
+	return kind
+}
+
+// pickPeer return the owner of key, unless ctx serves a forwarded
+// request. The peer that forwarded it thinks we own key, so a remote
+// owner means the rings of the two peers disagree
+func (g *Group) pickPeer(ctx context.Context, key string) (PeerGetter, bool) {
+	if g.peers == nil {
+		return nil, false
+	}
+	peer, ok := g.peers.PickPeer(key)
+	if ok && isForwarded(ctx) {
+		// a fallback or bounded request is sent past the owner on purpose
+		if forwardedKind(ctx) == forwardOwner {
+			g.ringDisagreement(key)
+		}
+		return nil, false
+	}
+	return peer, ok
+}
+
+func (g *Group) ringDisagreement(key string) {
+	g.stats.ringDisagreements.Add(1)
+	log.Printf("[toyCache] Peer forwarded %s/%s owned by another peer, serving it locally", g.name, key)
+}
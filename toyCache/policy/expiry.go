@@ -0,0 +1,94 @@
+package policy
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Expiries tracks the deadline of keys so the expired ones can be
+// found without scanning the whole store, it is not safe for concurrent access
+type Expiries struct {
+	h     expiryHeap
+	items map[string]*expiryItem // lazily initialization
+}
+
+type expiryItem struct {
+	key    string
+	expire time.Time
+	index  int
+}
+
+// Set record the deadline of key, a zero expire forgets it
+func (e *Expiries) Set(key string, expire time.Time) {
+	if expire.IsZero() {
+		e.Delete(key)
+		return
+	}
+	if e.items == nil {
+		e.items = make(map[string]*expiryItem)
+	}
+	if it, ok := e.items[key]; ok {
+		it.expire = expire
+		heap.Fix(&e.h, it.index)
+		return
+	}
+	it := &expiryItem{key: key, expire: expire}
+	e.items[key] = it
+	heap.Push(&e.h, it)
+}
+
+// Delete forgets the deadline of key
+func (e *Expiries) Delete(key string) {
+	if it, ok := e.items[key]; ok {
+		heap.Remove(&e.h, it.index)
+		delete(e.items, key)
+	}
+}
+
+// Expired report whether key has a deadline which is not after now
+func (e *Expiries) Expired(key string, now time.Time) bool {
+	it, ok := e.items[key]
+	return ok && !now.Before(it.expire)
+}
+
+// Deadline return the deadline of key, zero if it has none
+func (e *Expiries) Deadline(key string) time.Time {
+	if it, ok := e.items[key]; ok {
+		return it.expire
+	}
+	return time.Time{}
+}
+
+// Next return the key with the soonest deadline if it is not after now
+func (e *Expiries) Next(now time.Time) (key string, ok bool) {
+	if len(e.h) == 0 || now.Before(e.h[0].expire) {
+		return "", false
+	}
+	return e.h[0].key, true
+}
+
+// expiryHeap is a min-heap of items ordered by deadline
+type expiryHeap []*expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expire.Before(h[j].expire) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	it := x.(*expiryItem)
+	it.index = len(*h)
+	*h = append(*h, it)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return it
+}
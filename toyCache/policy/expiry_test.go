@@ -0,0 +1,33 @@
+package policy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiries(t *testing.T) {
+	var e Expiries
+	now := time.Now()
+	e.Set("key1", now.Add(2*time.Second))
+	e.Set("key2", now.Add(time.Second))
+	e.Set("key3", now.Add(3*time.Second))
+	e.Set("key3", time.Time{})
+
+	if key, ok := e.Next(now); ok {
+		t.Fatalf("no key should be expired but got %s", key)
+	}
+	later := now.Add(2 * time.Second)
+	if key, ok := e.Next(later); !ok || key != "key2" {
+		t.Fatalf("expect key2 to expire first but got %s", key)
+	}
+	if !e.Expired("key1", later) || e.Expired("key3", later) {
+		t.Fatalf("expect key1 expired and key3 without deadline")
+	}
+	e.Delete("key2")
+	if key, _ := e.Next(later); key != "key1" {
+		t.Fatalf("expect key1 after deleting key2 but got %s", key)
+	}
+	if !e.Deadline("key3").IsZero() {
+		t.Fatalf("key3 deadline should be zero")
+	}
+}
@@ -0,0 +1,35 @@
+// Package policy defines what an eviction policy must provide to be
+// used as the store of a toyCache cache
+package policy
+
+import "time"
+
+// Value used Len() to get how many bytes is takes
+type Value interface {
+	Len() int
+}
+
+// Policy is a store bounded in bytes that decides which entries to evict
+// when it is full, it is not safe for concurrent access.
+// The bytes of an entry are len(key) + value.Len()
+type Policy interface {
+	// AddWithExpire adds a value which will be treated as missing after
+	// expire, a zero expire means the value never expire
+	AddWithExpire(key string, value Value, expire time.Time)
+	// Get look ups a key's value
+	Get(key string) (value Value, ok bool)
+	// Remove removes the provided key
+	Remove(key string)
+	// RemoveExpired remove all items whose deadline has passed
+	RemoveExpired()
+	// Deadline return the deadline of key, zero if it has none
+	Deadline(key string) time.Time
+	// Walk calls fn for every entry with its deadline, least valuable
+	// first, so adding them in that order rebuilds a similar store.
+	// fn must not modify the store
+	Walk(fn func(key string, value Value, expire time.Time))
+	// Len return the number of entries
+	Len() int
+	// Bytes return the number of bytes taken by keys and values
+	Bytes() int64
+}
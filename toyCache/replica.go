@@ -0,0 +1,99 @@
+package toyCache
+
+import (
+	"context"
+	"errors"
+	pb "github.com/toyCache/toyCache/toycachepb"
+	"log"
+	"time"
+)
+
+// replicaFillTimeout bounds the requests filling the replicas
+// of a key after it was loaded
+const replicaFillTimeout = 5 * time.Second
+
+// replicas return the peers holding key, primary first and nil for
+// the local peer, or nothing when the keys are not replicated
+func (g *Group) replicas(key string) []PeerGetter {
+	if rp, ok := g.peers.(ReplicaPicker); ok {
+		return rp.PickReplicas(key)
+	}
+	return nil
+}
+
+// isReplica report whether the local peer is one of replicas
+func isReplica(replicas []PeerGetter) bool {
+	for _, peer := range replicas {
+		if peer == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// eachReplica call fn for every remote replica and return the first error
+func (g *Group) eachReplica(replicas []PeerGetter, fn func(peer PeerGetter) error) error {
+	var first error
+	for _, peer := range replicas {
+		if peer == nil {
+			continue
+		}
+		if err := fn(peer); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// loadFromReplicas ask the replicas in order until one answers, the
+// local peer loads with its Getter when it comes first or all failed.
+// A value loaded locally is copied to the other replicas
+func (g *Group) loadFromReplicas(ctx context.Context, key string, replicas []PeerGetter) (ByteView, error) {
+	// a peer already asked us, don't ask the other replicas but
+	// still fill them with what we load
+	forwarded := isForwarded(ctx)
+	if forwarded && !isReplica(replicas) {
+		g.ringDisagreement(key)
+	}
+	for _, peer := range replicas {
+		if peer == nil || forwarded {
+			break
+		}
+		value, err := g.getFromPeer(ctx, peer, key)
+		if err == nil {
+			g.stats.peerLoads.Add(1)
+			return value, nil
+		}
+		if errors.Is(err, ErrNotFound) {
+			g.stats.peerLoads.Add(1)
+			g.populateNegative(key, err)
+			return ByteView{}, err
+		}
+		g.stats.peerErrors.Add(1)
+		log.Println("[toyCache] Failed to get from replica", err)
+	}
+	value, err := g.getLocally(ctx, key)
+	if err != nil {
+		g.populateNegative(key, err)
+		return ByteView{}, err
+	}
+	g.fillReplicas(key, value, replicas)
+	return value, nil
+}
+
+// fillReplicas copy value to the remote replicas in the background
+func (g *Group) fillReplicas(key string, value ByteView, replicas []PeerGetter) {
+	req := &pb.SetRequest{Group: g.name, Key: key, Value: value.b}
+	for _, peer := range replicas {
+		if peer == nil {
+			continue
+		}
+		go func(peer PeerGetter) {
+			ctx, cancel := context.WithTimeout(context.Background(), replicaFillTimeout)
+			defer cancel()
+			if err := peer.Set(ctx, req, &pb.SetResponse{}); err != nil {
+				log.Println("[toyCache] Failed to fill replica", err)
+			}
+		}(peer)
+	}
+}
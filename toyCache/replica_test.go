@@ -0,0 +1,134 @@
+package toyCache
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	pb "github.com/toyCache/toyCache/toycachepb"
+	"sync"
+	"testing"
+	"time"
+)
+
+// replicaPeer is a peer safe for the concurrent replica fills
+type replicaPeer struct {
+	mu   sync.Mutex
+	down bool
+	gets int
+	set  map[string]string
+}
+
+func (p *replicaPeer) Get(_ context.Context, in *pb.Request, out *pb.Response) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gets++
+	if p.down {
+		return errors.New("connection refused")
+	}
+	out.Value = []byte("replica:" + in.Key)
+	return nil
+}
+
+func (p *replicaPeer) Delete(_ context.Context, in *pb.Request, out *pb.DeleteResponse) error {
+	return nil
+}
+
+func (p *replicaPeer) Set(_ context.Context, in *pb.SetRequest, out *pb.SetResponse) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.set == nil {
+		p.set = make(map[string]string)
+	}
+	p.set[in.Key] = string(in.Value)
+	return nil
+}
+
+func (p *replicaPeer) value(key string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.set[key]
+}
+
+type replicaPicker []PeerGetter
+
+func (p replicaPicker) PickPeer(key string) (PeerGetter, bool) {
+	return p[0], p[0] != nil
+}
+
+func (p replicaPicker) PickReplicas(key string) []PeerGetter {
+	return p
+}
+
+func TestReplicaFallback(t *testing.T) {
+	loads := 0
+	toyC := NewGroup("replicaFallback", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}))
+	primary, secondary := &replicaPeer{down: true}, &replicaPeer{}
+	toyC.RegisterPeer(replicaPicker{primary, secondary})
+
+	view, err := getView(toyC, context.Background(), "Tom")
+	require.NoError(t, err)
+	require.Equal(t, "replica:Tom", view.String(), "reader should fall back to the next replica")
+	require.Equal(t, 1, primary.gets)
+	require.Equal(t, 0, loads)
+	require.Equal(t, int64(1), toyC.Stats().PeerErrors)
+}
+
+func TestReplicaFill(t *testing.T) {
+	loads := 0
+	toyC := NewGroup("replicaFill", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}))
+	r1, r2 := &replicaPeer{}, &replicaPeer{}
+	toyC.RegisterPeer(replicaPicker{nil, r1, r2})
+
+	view, err := getView(toyC, context.Background(), "Tom")
+	require.NoError(t, err)
+	require.Equal(t, "Tom", view.String(), "primary should load with its Getter")
+	require.Equal(t, 1, loads)
+	require.Eventually(t, func() bool {
+		return r1.value("Tom") == "Tom" && r2.value("Tom") == "Tom"
+	}, time.Second, 10*time.Millisecond, "primary should fill its replicas")
+
+	require.NoError(t, toyC.Set(context.Background(), "Bob", []byte("123")))
+	require.Equal(t, "123", r1.value("Bob"))
+	require.Equal(t, "123", r2.value("Bob"))
+	require.Equal(t, int64(2), toyC.CacheStats(MainCache).Items, "primary should keep the value it sets")
+}
+
+func TestReplicaFillForwarded(t *testing.T) {
+	toyC := NewGroup("replicaFillForwarded", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	r1, r2 := &replicaPeer{}, &replicaPeer{}
+	toyC.RegisterPeer(replicaPicker{nil, r1, r2})
+
+	// a reader forwarded the key to us, the primary
+	view, err := getView(toyC, withForwarded(context.Background(), forwardOwner), "Tom")
+	require.NoError(t, err)
+	require.Equal(t, "Tom", view.String())
+	require.Equal(t, 0, r1.gets+r2.gets, "forwarded request should not be sent to the other replicas")
+	require.Eventually(t, func() bool {
+		return r1.value("Tom") == "Tom" && r2.value("Tom") == "Tom"
+	}, time.Second, 10*time.Millisecond, "primary should fill its replicas after a forwarded load")
+	require.Equal(t, int64(0), toyC.Stats().RingDisagreements)
+}
+
+func TestHTTPPoolPickReplicas(t *testing.T) {
+	pool := NewHTTPPoolOpts("http://localhost:8001", &HTTPPoolOptions{ReplicationFactor: 2})
+	pool.Set("http://localhost:8001", "http://localhost:8002", "http://localhost:8003")
+	local := 0
+	for _, key := range []string{"Tom", "Bob", "Jack", "Sam", "Ann", "Joe"} {
+		replicas := pool.PickReplicas(key)
+		require.Len(t, replicas, 2)
+		if isReplica(replicas) {
+			local++
+		}
+	}
+	require.Greater(t, local, 0, "local peer should hold some replicas")
+
+	require.Nil(t, NewHTTPPool("http://localhost:8001").PickReplicas("Tom"), "keys should not be replicated by default")
+}
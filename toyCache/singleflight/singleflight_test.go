@@ -1,8 +1,11 @@
 package singleflight
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/require"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -11,13 +14,24 @@ import (
 
 func TestDo(t *testing.T) {
 	var g Group
-	v, err := g.Do("key", func() (interface{}, error) {
+	v, err, shared := g.Do("key", func() (interface{}, error) {
 		return "foo", nil
 	})
 	got := fmt.Sprintf("%v (%T)", v, v)
 	want := "foo (string)"
 	require.Equal(t, want, got)
 	require.NoError(t, err)
+	require.False(t, shared, "a single caller should not share its result")
+}
+
+func TestDoErr(t *testing.T) {
+	var g Group
+	someErr := errors.New("some error")
+	v, err, _ := g.Do("key", func() (interface{}, error) {
+		return nil, someErr
+	})
+	require.Equal(t, someErr, err)
+	require.Nil(t, v)
 }
 
 func TestDoDupSuppress(t *testing.T) {
@@ -32,13 +46,16 @@ func TestDoDupSuppress(t *testing.T) {
 	for i:=0; i < 10; i++ {
 		wg.Add(1)
 		go func() {
-			v, err := g.Do("key", fn)
+			v, err, shared := g.Do("key", fn)
 			if err != nil{
 				t.Errorf("Do error %v", err)
 			}
 			if v.(string) != "foo" {
 				t.Errorf("got %v but expecte %v", v.(string), "foo")
 			}
+			if !shared {
+				t.Errorf("result should be shared by the duplicate callers")
+			}
 			wg.Done()
 		}()
 	}
@@ -48,4 +65,169 @@ func TestDoDupSuppress(t *testing.T) {
 	if got := atomic.LoadInt32(&calls); got != 1 {
 		t.Errorf("number of call expect 1 but got %v", got)
 	}
-}
\ No newline at end of file
+}
+
+func TestDoChan(t *testing.T) {
+	var g Group
+	release := make(chan struct{})
+	var calls int32
+	fn := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "bar", nil
+	}
+	first := g.DoChan("key", fn)
+	second := g.DoChan("key", fn)
+	close(release)
+	for _, ch := range []<-chan Result{first, second} {
+		select {
+		case res := <-ch:
+			require.NoError(t, res.Err)
+			require.Equal(t, "bar", res.Val)
+			require.True(t, res.Shared)
+		case <-time.After(time.Second):
+			t.Fatal("DoChan should deliver the result")
+		}
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestDoChanLeader(t *testing.T) {
+	var g Group
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		<-release
+		return "baz", nil
+	}
+	first, leader := g.DoChanLeader("key", fn)
+	require.True(t, leader, "the first caller should run fn")
+	second, leader := g.DoChanLeader("key", fn)
+	require.False(t, leader, "a duplicate caller should join the call in flight")
+	close(release)
+	for _, ch := range []<-chan Result{first, second} {
+		res := <-ch
+		require.NoError(t, res.Err)
+		require.Equal(t, "baz", res.Val)
+	}
+}
+
+func TestForget(t *testing.T) {
+	var g Group
+	stuck := make(chan struct{})
+	defer close(stuck)
+	go g.Do("key", func() (interface{}, error) {
+		<-stuck
+		return nil, nil
+	})
+	require.Eventually(t, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return len(g.m) == 1
+	}, time.Second, time.Millisecond)
+
+	g.Forget("key")
+	v, err, shared := g.Do("key", func() (interface{}, error) {
+		return "fresh", nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "fresh", v, "a forgotten call should not be waited for")
+	require.False(t, shared)
+}
+
+func TestDoContextWaiterGivesUp(t *testing.T) {
+	var g Group
+	release := make(chan struct{})
+	leader := make(chan interface{})
+	go func() {
+		v, _, _ := g.Do("key", func() (interface{}, error) {
+			<-release
+			return "slow", nil
+		})
+		leader <- v
+	}()
+	require.Eventually(t, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return len(g.m) == 1
+	}, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err, shared := g.DoContext(ctx, "key", func() (interface{}, error) {
+		return "dup", nil
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.True(t, shared)
+
+	close(release)
+	require.Equal(t, "slow", <-leader, "leader should not be cancelled by a waiter")
+}
+
+func TestPanicDo(t *testing.T) {
+	var g Group
+	fn := func() (interface{}, error) {
+		panic("invalid memory address or nil pointer dereference")
+	}
+	const n = 5
+	waited := int32(n)
+	panicCount := int32(0)
+	done := make(chan struct{})
+	for i := 0; i < n; i++ {
+		go func() {
+			defer func() {
+				if err := recover(); err != nil {
+					atomic.AddInt32(&panicCount, 1)
+				}
+				if atomic.AddInt32(&waited, -1) == 0 {
+					close(done)
+				}
+			}()
+			g.Do("key", fn)
+		}()
+	}
+	select {
+	case <-done:
+		require.Equal(t, int32(n), atomic.LoadInt32(&panicCount), "every caller should panic")
+	case <-time.After(time.Second):
+		t.Fatal("Do hangs")
+	}
+
+	v, err, _ := g.Do("key", func() (interface{}, error) {
+		return "ok", nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "ok", v, "a panic should not leave the key behind")
+}
+
+func TestGoexitDo(t *testing.T) {
+	var g Group
+	fn := func() (interface{}, error) {
+		runtime.Goexit()
+		return nil, nil
+	}
+	const n = 5
+	waited := int32(n)
+	done := make(chan struct{})
+	for i := 0; i < n; i++ {
+		go func() {
+			var err error
+			defer func() {
+				if err != nil {
+					t.Errorf("Do should not return, got %v", err)
+				}
+				if atomic.AddInt32(&waited, -1) == 0 {
+					close(done)
+				}
+			}()
+			_, err, _ = g.Do("key", fn)
+		}()
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Do hangs")
+	}
+
+	res := <-g.DoChan("key", fn)
+	require.ErrorIs(t, res.Err, errGoexit, "channel waiters should learn about Goexit")
+}
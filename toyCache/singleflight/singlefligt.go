@@ -1,12 +1,54 @@
 package singleflight
 
-import "sync"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// errGoexit is returned to the duplicate callers when fn called runtime.Goexit
+var errGoexit = errors.New("runtime.Goexit was called")
+
+// panicError is a value recovered from a panic of fn along with its stack
+type panicError struct {
+	value interface{}
+	stack []byte
+}
+
+func (p *panicError) Error() string {
+	return fmt.Sprintf("%v\n\n%s", p.value, p.stack)
+}
+
+func newPanicError(v interface{}) error {
+	stack := debug.Stack()
+	// the first line is "goroutine N [status]:", the goroutine may be gone
+	// by the time the panic is rethrown so drop the misleading line
+	if line := bytes.IndexByte(stack, '\n'); line >= 0 {
+		stack = stack[line+1:]
+	}
+	return &panicError{value: v, stack: stack}
+}
 
 // call is an in-flight(calling) or completed Do call
 type call struct {
-	wg sync.WaitGroup
-	val interface{}
-	err error
+	done chan struct{} // closed when fn returns
+	val  interface{}
+	err  error
+
+	// dups and chans are written with Group.mu held
+	dups  int
+	chans []chan<- Result
+}
+
+// Result holds the results of Do, so they can be passed on a channel
+type Result struct {
+	Val    interface{}
+	Err    error
+	Shared bool
 }
 
 // Group represent a class of work and forms a namespace in which
@@ -19,28 +61,131 @@ type Group struct {
 // Do executes and return the result of given function, making sure that
 // only one executed in flight for a given key at a time.
 // If a duplicate comes in, the duplicate caller waits for the previous caller
-// complete and receives the same results
-func (g *Group) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+// complete and receives the same results. shared reports whether v was
+// given to more than one caller. A panic of fn is rethrown in every caller
+func (g *Group) Do(key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
+	return g.DoContext(context.Background(), key, fn)
+}
+
+// DoContext is like Do but a duplicate caller stops waiting when ctx is
+// done and return ctx.Err(), the call keeps running for the others
+func (g *Group) DoContext(ctx context.Context, key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*call)
+	}
+	if c, ok := g.m[key]; ok {
+		c.dups++
+		g.mu.Unlock()
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return nil, ctx.Err(), true
+		}
+		if e, ok := c.err.(*panicError); ok {
+			panic(e)
+		} else if c.err == errGoexit {
+			runtime.Goexit()
+		}
+		return c.val, c.err, true
+	}
+	c := &call{done: make(chan struct{})}
+	g.m[key] = c
+	g.mu.Unlock()
+
+	g.doCall(c, key, fn)
 	g.mu.Lock()
+	shared = c.dups > 0
+	g.mu.Unlock()
+	return c.val, c.err, shared
+}
+
+// DoChan is like Do but return a channel that receives the results when
+// they are ready. The channel is not closed
+func (g *Group) DoChan(key string, fn func() (interface{}, error)) <-chan Result {
+	ch, _ := g.DoChanLeader(key, fn)
+	return ch
+}
 
+// DoChanLeader is like DoChan and also report whether fn runs for this
+// caller, it is false when the caller joined a call in flight
+func (g *Group) DoChanLeader(key string, fn func() (interface{}, error)) (<-chan Result, bool) {
+	ch := make(chan Result, 1)
+	g.mu.Lock()
 	if g.m == nil {
 		g.m = make(map[string]*call)
 	}
 	if c, ok := g.m[key]; ok {
+		c.dups++
+		c.chans = append(c.chans, ch)
 		g.mu.Unlock()
-		c.wg.Wait()
-		return c.val, c.err
+		return ch, false
 	}
-	c := new(call)
-	c.wg.Add(1)
+	c := &call{done: make(chan struct{}), chans: []chan<- Result{ch}}
 	g.m[key] = c
 	g.mu.Unlock()
-	c.val, c.err = fn()
-	c.wg.Done()
 
+	go g.doCall(c, key, fn)
+	return ch, true
+}
+
+// Forget tells the group to forget about key, the next Do of key calls
+// fn instead of waiting for the call in flight
+func (g *Group) Forget(key string) {
 	g.mu.Lock()
 	delete(g.m, key)
 	g.mu.Unlock()
+}
+
+// doCall run fn and hand its results to the waiters, even when it panics
+// or calls runtime.Goexit
+func (g *Group) doCall(c *call, key string, fn func() (interface{}, error)) {
+	normalReturn := false
+	recovered := false
+
+	// the double defer tells a panic from runtime.Goexit, a recovered
+	// panic returns from the inner func while Goexit never does
+	defer func() {
+		if !normalReturn && !recovered {
+			c.err = errGoexit
+		}
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		close(c.done)
+		if g.m[key] == c {
+			delete(g.m, key)
+		}
 
-	return c.val, c.err
-}
\ No newline at end of file
+		if e, ok := c.err.(*panicError); ok {
+			if len(c.chans) > 0 {
+				// a channel waiter would block forever, make sure the
+				// panic cannot be recovered and crash instead
+				go panic(e)
+				select {}
+			}
+			panic(e)
+		}
+		// on runtime.Goexit the channel waiters get errGoexit,
+		// the goroutine is already exiting
+		for _, ch := range c.chans {
+			ch <- Result{Val: c.val, Err: c.err, Shared: c.dups > 0}
+		}
+	}()
+
+	func() {
+		defer func() {
+			if !normalReturn {
+				if r := recover(); r != nil {
+					c.err = newPanicError(r)
+				}
+			}
+		}()
+		c.val, c.err = fn()
+		normalReturn = true
+	}()
+
+	if !normalReturn {
+		recovered = true
+	}
+}
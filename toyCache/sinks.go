@@ -0,0 +1,171 @@
+package toyCache
+
+import (
+	"encoding/json"
+	"errors"
+	"google.golang.org/protobuf/proto"
+)
+
+// Sink receives the value of a Get call,
+// a Getter also writes the loaded value into a Sink
+type Sink interface {
+	// SetString sets the value to s
+	SetString(s string) error
+
+	// SetBytes sets the value to the contents of v,
+	// the caller retains ownership of v
+	SetBytes(v []byte) error
+
+	// SetProto sets the value to the encoded version of m,
+	// the caller retains ownership of m
+	SetProto(m proto.Message) error
+}
+
+// setSinkView fill s with v without copying when s can share it
+func setSinkView(s Sink, v ByteView) error {
+	if vs, ok := s.(*byteViewSink); ok {
+		*vs.dst = v
+		return nil
+	}
+	return s.SetBytes(v.b)
+}
+
+// StringSink return a Sink that populates the provided string pointer
+func StringSink(sp *string) Sink {
+	return &stringSink{sp: sp}
+}
+
+type stringSink struct {
+	sp *string
+}
+
+func (s *stringSink) SetString(v string) error {
+	*s.sp = v
+	return nil
+}
+
+func (s *stringSink) SetBytes(v []byte) error {
+	*s.sp = string(v)
+	return nil
+}
+
+func (s *stringSink) SetProto(m proto.Message) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	*s.sp = string(b)
+	return nil
+}
+
+// ByteViewSink return a Sink that populates a ByteView
+func ByteViewSink(dst *ByteView) Sink {
+	if dst == nil {
+		panic("nil dst")
+	}
+	return &byteViewSink{dst: dst}
+}
+
+type byteViewSink struct {
+	dst *ByteView
+}
+
+func (s *byteViewSink) SetString(v string) error {
+	*s.dst = ByteView{b: []byte(v)}
+	return nil
+}
+
+func (s *byteViewSink) SetBytes(v []byte) error {
+	*s.dst = ByteView{b: cloneBytes(v)}
+	return nil
+}
+
+func (s *byteViewSink) SetProto(m proto.Message) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	*s.dst = ByteView{b: b}
+	return nil
+}
+
+// AllocatingByteSliceSink return a Sink that allocates a byte slice
+// to hold the received value and assigns it to *dst,
+// the memory is not retained by toyCache
+func AllocatingByteSliceSink(dst *[]byte) Sink {
+	return &allocBytesSink{dst: dst}
+}
+
+type allocBytesSink struct {
+	dst *[]byte
+}
+
+func (s *allocBytesSink) SetString(v string) error {
+	return s.setBytesOwned([]byte(v))
+}
+
+func (s *allocBytesSink) SetBytes(v []byte) error {
+	return s.setBytesOwned(cloneBytes(v))
+}
+
+func (s *allocBytesSink) SetProto(m proto.Message) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.setBytesOwned(b)
+}
+
+func (s *allocBytesSink) setBytesOwned(b []byte) error {
+	if s.dst == nil {
+		return errors.New("nil AllocatingByteSliceSink *[]byte dst")
+	}
+	*s.dst = b
+	return nil
+}
+
+// ProtoSink return a Sink that unmarshals binary proto values into m
+func ProtoSink(m proto.Message) Sink {
+	return &protoSink{dst: m}
+}
+
+type protoSink struct {
+	dst proto.Message
+}
+
+func (s *protoSink) SetString(v string) error {
+	return proto.Unmarshal([]byte(v), s.dst)
+}
+
+func (s *protoSink) SetBytes(b []byte) error {
+	return proto.Unmarshal(b, s.dst)
+}
+
+func (s *protoSink) SetProto(m proto.Message) error {
+	proto.Reset(s.dst)
+	proto.Merge(s.dst, m)
+	return nil
+}
+
+// JSONSink return a Sink that unmarshals JSON values into v,
+// v must be a pointer as for json.Unmarshal
+func JSONSink(v interface{}) Sink {
+	return &jsonSink{dst: v}
+}
+
+type jsonSink struct {
+	dst interface{}
+}
+
+func (s *jsonSink) SetString(v string) error {
+	return json.Unmarshal([]byte(v), s.dst)
+}
+
+func (s *jsonSink) SetBytes(b []byte) error {
+	return json.Unmarshal(b, s.dst)
+}
+
+// SetProto fails as a JSONSink only holds JSON values
+func (s *jsonSink) SetProto(m proto.Message) error {
+	return errors.New("toyCache: JSONSink does not accept proto messages")
+}
@@ -0,0 +1,60 @@
+package toyCache
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	pb "github.com/toyCache/toyCache/toycachepb"
+	"testing"
+)
+
+func TestSinks(t *testing.T) {
+	toyC := NewGroup("sinks", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	ctx := context.Background()
+
+	var s string
+	require.NoError(t, toyC.Get(ctx, "Tom", StringSink(&s)))
+	require.Equal(t, "Tom", s)
+
+	var b []byte
+	require.NoError(t, toyC.Get(ctx, "Tom", AllocatingByteSliceSink(&b)))
+	require.Equal(t, []byte("Tom"), b)
+	b[0] = 'X'
+	view, err := getView(toyC, ctx, "Tom")
+	require.NoError(t, err)
+	require.Equal(t, "Tom", view.String(), "cached value should not be shared")
+
+	require.Error(t, toyC.Get(ctx, "Tom", nil))
+}
+
+func TestProtoSink(t *testing.T) {
+	loads := 0
+	toyC := NewGroup("protoSink", 2<<10, SinkGetterFunc(func(_ context.Context, key string, dest Sink) error {
+		loads++
+		return dest.SetProto(&pb.Request{Group: "protoSink", Key: key})
+	}))
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		var req pb.Request
+		require.NoError(t, toyC.Get(ctx, "Tom", ProtoSink(&req)))
+		require.Equal(t, "Tom", req.Key)
+		require.Equal(t, "protoSink", req.Group)
+	}
+	require.Equal(t, 1, loads)
+}
+
+func TestJSONSink(t *testing.T) {
+	toyC := NewGroup("jsonSink", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(`{"name":"` + key + `","score":630}`), nil
+	}))
+	var v struct {
+		Name  string `json:"name"`
+		Score int    `json:"score"`
+	}
+	require.NoError(t, toyC.Get(context.Background(), "Tom", JSONSink(&v)))
+	require.Equal(t, "Tom", v.Name)
+	require.Equal(t, 630, v.Score)
+
+	require.Error(t, JSONSink(&v).SetProto(&pb.Request{}))
+}
@@ -0,0 +1,273 @@
+package toyCache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// A snapshot is
+//
+//	magic "TCSN" | version byte | uvarint len(group) | group | uvarint count |
+//	count * (uvarint len(key) | key | uvarint len(value) | value | varint expire) |
+//	crc32c of all the previous bytes, little endian
+//
+// where expire is in unix nanoseconds and zero when the entry never expire
+const (
+	snapshotMagic   = "TCSN"
+	snapshotVersion = 1
+
+	// maxSnapshotField bounds the lengths read from a snapshot so a
+	// corrupted one fails instead of allocating huge buffers
+	maxSnapshotField = 1 << 30
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrBadSnapshot is returned when a snapshot is corrupted or was
+// written by an unsupported version
+var ErrBadSnapshot = errors.New("toyCache: bad snapshot")
+
+// WithSnapshot make the group warm itself from the snapshot at path when
+// created, and save its main cache to path every interval until Close
+func WithSnapshot(path string, interval time.Duration) GroupOption {
+	return func(g *Group) {
+		g.snapshotPath = path
+		g.snapshotInterval = interval
+	}
+}
+
+// SaveSnapshot write the entries of the main cache to w, least
+// recently used first. Expired entries are left out
+func (g *Group) SaveSnapshot(w io.Writer) error {
+	now := time.Now()
+	var list []snapshotEntry
+	for _, e := range g.mainCache.entries() {
+		if e.expire.IsZero() || now.Before(e.expire) {
+			list = append(list, e)
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	crc := crc32.New(crcTable)
+	sw := &snapshotWriter{w: io.MultiWriter(bw, crc)}
+	sw.write([]byte(snapshotMagic))
+	sw.write([]byte{snapshotVersion})
+	sw.writeBytes([]byte(g.name))
+	sw.writeUvarint(uint64(len(list)))
+	for _, e := range list {
+		sw.writeBytes([]byte(e.key))
+		sw.writeBytes(e.value.b)
+		var expire int64
+		if !e.expire.IsZero() {
+			expire = e.expire.UnixNano()
+		}
+		n := binary.PutVarint(sw.buf[:], expire)
+		sw.write(sw.buf[:n])
+	}
+	if sw.err != nil {
+		return sw.err
+	}
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc.Sum32())
+	if _, err := bw.Write(sum[:]); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// LoadSnapshot add the entries of a snapshot written by SaveSnapshot
+// to the main cache, nothing is added if the snapshot is corrupted
+func (g *Group) LoadSnapshot(r io.Reader) error {
+	list, err := g.readSnapshot(r)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: truncated", ErrBadSnapshot)
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, e := range list {
+		if e.expire.IsZero() || now.Before(e.expire) {
+			g.mainCache.add(e.key, e.value, e.expire, time.Time{})
+		}
+	}
+	return nil
+}
+
+func (g *Group) readSnapshot(r io.Reader) ([]snapshotEntry, error) {
+	sr := &snapshotReader{r: bufio.NewReader(r), crc: crc32.New(crcTable)}
+	magic := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(sr, magic); err != nil {
+		return nil, err
+	}
+	if string(magic[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, fmt.Errorf("%w: not a snapshot", ErrBadSnapshot)
+	}
+	if magic[len(snapshotMagic)] != snapshotVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrBadSnapshot, magic[len(snapshotMagic)])
+	}
+	name, err := sr.readBytes()
+	if err != nil {
+		return nil, err
+	}
+	if string(name) != g.name {
+		return nil, fmt.Errorf("%w: snapshot of group %q", ErrBadSnapshot, name)
+	}
+	count, err := binary.ReadUvarint(sr)
+	if err != nil {
+		return nil, err
+	}
+	var list []snapshotEntry
+	for i := uint64(0); i < count; i++ {
+		key, err := sr.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		value, err := sr.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		expire, err := binary.ReadVarint(sr)
+		if err != nil {
+			return nil, err
+		}
+		e := snapshotEntry{key: string(key), value: ByteView{b: value}}
+		if expire != 0 {
+			e.expire = time.Unix(0, expire)
+		}
+		list = append(list, e)
+	}
+	var sum [4]byte
+	if _, err := io.ReadFull(sr.r, sum[:]); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(sum[:]) != sr.crc.Sum32() {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrBadSnapshot)
+	}
+	return list, nil
+}
+
+// SaveSnapshotFile write a snapshot to path, it replaces the previous
+// file only once the new one is fully written
+func (g *Group) SaveSnapshotFile(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = g.SaveSnapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadSnapshotFile load the snapshot at path
+func (g *Group) LoadSnapshotFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return g.LoadSnapshot(f)
+}
+
+// startSnapshots warm the group from its snapshot file and save it
+// every snapshotInterval until the group is closed
+func (g *Group) startSnapshots() {
+	if err := g.LoadSnapshotFile(g.snapshotPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println("[toyCache] Failed to load snapshot", err)
+	}
+	if g.snapshotInterval <= 0 {
+		return
+	}
+	g.background.Add(1)
+	go func() {
+		defer g.background.Done()
+		ticker := time.NewTicker(g.snapshotInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := g.SaveSnapshotFile(g.snapshotPath); err != nil {
+					log.Println("[toyCache] Failed to save snapshot", err)
+				}
+			case <-g.done:
+				return
+			}
+		}
+	}()
+}
+
+// snapshotWriter keeps the first error so writes can be chained
+type snapshotWriter struct {
+	w   io.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (w *snapshotWriter) write(b []byte) {
+	if w.err == nil {
+		_, w.err = w.w.Write(b)
+	}
+}
+
+func (w *snapshotWriter) writeUvarint(x uint64) {
+	n := binary.PutUvarint(w.buf[:], x)
+	w.write(w.buf[:n])
+}
+
+func (w *snapshotWriter) writeBytes(b []byte) {
+	w.writeUvarint(uint64(len(b)))
+	w.write(b)
+}
+
+// snapshotReader checksums the bytes read through it
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (r *snapshotReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.crc.Write(p[:n])
+	return n, err
+}
+
+func (r *snapshotReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (r *snapshotReader) readBytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxSnapshotField {
+		return nil, fmt.Errorf("%w: field of %d bytes", ErrBadSnapshot, n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
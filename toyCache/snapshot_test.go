@@ -0,0 +1,99 @@
+package toyCache
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	})
+	src := NewGroup("snapshot", 2<<10, getter, WithTTL(time.Hour))
+	ctx := context.Background()
+	for _, key := range []string{"Tom", "Bob", "Jack"} {
+		_, err := getView(src, ctx, key)
+		require.NoError(t, err)
+	}
+	var buf bytes.Buffer
+	require.NoError(t, src.SaveSnapshot(&buf))
+
+	loads := 0
+	dst := NewGroup("snapshot", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}))
+	require.NoError(t, dst.LoadSnapshot(bytes.NewReader(buf.Bytes())))
+	for _, key := range []string{"Tom", "Bob", "Jack"} {
+		view, err := getView(dst, ctx, key)
+		require.NoError(t, err)
+		require.Equal(t, key, view.String())
+	}
+	require.Equal(t, 0, loads, "snapshot entries should not be loaded")
+
+	var order []string
+	for _, e := range dst.mainCache.entries() {
+		order = append(order, e.key)
+		require.WithinDuration(t, time.Now().Add(time.Hour), e.expire, time.Minute, "ttl should be kept")
+	}
+	require.Equal(t, []string{"Tom", "Bob", "Jack"}, order, "recency order should be kept")
+}
+
+func TestSnapshotCorrupted(t *testing.T) {
+	toyC := NewGroup("snapshotBad", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	_, err := getView(toyC, context.Background(), "Tom")
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, toyC.SaveSnapshot(&buf))
+	good := buf.Bytes()
+
+	flipped := append([]byte(nil), good...)
+	flipped[len(flipped)-6] ^= 0xff
+	require.ErrorIs(t, toyC.LoadSnapshot(bytes.NewReader(flipped)), ErrBadSnapshot)
+	require.ErrorIs(t, toyC.LoadSnapshot(bytes.NewReader(good[:len(good)-2])), ErrBadSnapshot)
+
+	other := NewGroup("snapshotOther", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	require.ErrorIs(t, other.LoadSnapshot(bytes.NewReader(good)), ErrBadSnapshot)
+	require.Equal(t, int64(0), other.CacheStats(MainCache).Items)
+}
+
+func TestWithSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scores.snap")
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	})
+	toyC := NewGroup("snapshotFile", 2<<10, getter, WithSnapshot(path, time.Hour))
+	_, err := getView(toyC, context.Background(), "Tom")
+	require.NoError(t, err)
+	require.NoError(t, toyC.SaveSnapshotFile(path))
+
+	restarted := NewGroup("snapshotFile", 2<<10, getter, WithSnapshot(path, time.Hour))
+	require.Equal(t, int64(1), restarted.CacheStats(MainCache).Items, "group should warm from its snapshot")
+}
+
+func TestCloseStopsSnapshots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scores.snap")
+	toyC := NewGroup("snapshotClose", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}), WithSnapshot(path, 5*time.Millisecond))
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, time.Millisecond, "snapshot should be saved every interval")
+
+	require.NoError(t, toyC.Close())
+	require.NoError(t, toyC.Close(), "Close should be idempotent")
+	require.NoError(t, os.Remove(path))
+	time.Sleep(20 * time.Millisecond)
+	_, err := os.Stat(path)
+	require.ErrorIs(t, err, os.ErrNotExist, "closed group should not save snapshots")
+}
@@ -0,0 +1,213 @@
+package toyCache
+
+import (
+	"context"
+	"errors"
+	"github.com/toyCache/toyCache/lru"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// refreshTimeout bounds a background reload
+	refreshTimeout = 10 * time.Second
+	// maxTrackedKeys bounds the keys counted for refresh-ahead
+	maxTrackedKeys = 4096
+	// staleCacheRatio is the part of the group cacheBytes given to
+	// the stale values kept by WithStaleIfError
+	staleCacheRatio = 8
+)
+
+// errStale is returned by getFromPeer when the owner answered with a
+// stale value, the value is kept in the stale cache
+var errStale = errors.New("toyCache: owner answered with a stale value")
+
+// WithSoftTTL make values stale softTTL after they are loaded, a stale
+// value is still returned and reloaded once in the background. It only
+// applies to values whose TTL, set with WithTTL or returned by a
+// TTLGetter, is above softTTL. The TTL stays the point values are dropped
+func WithSoftTTL(softTTL time.Duration) GroupOption {
+	return func(g *Group) {
+		g.softTTL = softTTL
+	}
+}
+
+// WithRefreshAhead reload the topN most read keys of every interval
+// when they expire within ahead, so hot keys never miss on expiry. It
+// runs until Close
+func WithRefreshAhead(interval, ahead time.Duration, topN int) GroupOption {
+	return func(g *Group) {
+		g.refreshInterval = interval
+		g.refreshAhead = ahead
+		g.refreshTopN = topN
+	}
+}
+
+// WithStaleIfError keep the values leaving the caches for grace, they
+// are served in place of the error when the key fails to load. Keys
+// not found and keys removed on purpose are never served stale
+func WithStaleIfError(grace time.Duration) GroupOption {
+	return func(g *Group) {
+		g.staleGrace = grace
+	}
+}
+
+// isStale report whether a value of mainCache is past its soft deadline
+func isStale(soft time.Time) bool {
+	return !soft.IsZero() && time.Now().After(soft)
+}
+
+// refresh reload key in the background, at most one reload of a key
+// is running at a time and none once the group is closed
+func (g *Group) refresh(key string) {
+	g.closeMu.Lock()
+	defer g.closeMu.Unlock()
+	select {
+	case <-g.done:
+		return
+	default:
+	}
+	if _, running := g.refreshing.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+	g.stats.refreshes.Add(1)
+	g.background.Add(1)
+	go func() {
+		defer g.background.Done()
+		defer g.refreshing.Delete(key)
+		ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+		defer cancel()
+		if _, err := g.load(ctx, key); err != nil {
+			log.Println("[toyCache] Failed to refresh", key, err)
+		}
+	}()
+}
+
+func (g *Group) startRefreshAhead() {
+	g.access = &accessCounter{counts: make(map[string]*access)}
+	g.background.Add(1)
+	go func() {
+		defer g.background.Done()
+		ticker := time.NewTicker(g.refreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, key := range g.access.due(g.refreshTopN, g.refreshAhead) {
+					g.refresh(key)
+				}
+			case <-g.done:
+				return
+			}
+		}
+	}()
+}
+
+// accessCounter counts the reads of mainCache keys, the counts are
+// halved every refresh-ahead tick so old reads fade out
+type accessCounter struct {
+	mu     sync.Mutex
+	counts map[string]*access
+}
+
+type access struct {
+	key    string
+	n      int64
+	expire time.Time // deadline of the value last read
+}
+
+func (a *accessCounter) hit(key string, expire time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if e, ok := a.counts[key]; ok {
+		e.n++
+		e.expire = expire
+		return
+	}
+	if len(a.counts) < maxTrackedKeys {
+		a.counts[key] = &access{key: key, n: 1, expire: expire}
+	}
+}
+
+// due return the keys among the n most read that expire within ahead
+func (a *accessCounter) due(n int, ahead time.Duration) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := make([]*access, 0, len(a.counts))
+	for _, e := range a.counts {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].n > list[j].n
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	var keys []string
+	for _, e := range list {
+		if !e.expire.IsZero() && time.Until(e.expire) < ahead {
+			keys = append(keys, e.key)
+			// the deadline is unknown until the reloaded value is read
+			e.expire = time.Time{}
+		}
+	}
+	for key, e := range a.counts {
+		if e.n /= 2; e.n == 0 {
+			delete(a.counts, key)
+		}
+	}
+	return keys
+}
+
+// staleCache holds the values recently expired or evicted from the
+// caches of a group
+type staleCache struct {
+	mu  sync.Mutex
+	lru *lru.Cache
+}
+
+func newStaleCache(cacheBytes int64) *staleCache {
+	return &staleCache{lru: lru.New(cacheBytes, nil)}
+}
+
+func (c *staleCache) add(key string, value ByteView, until time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.AddWithExpire(key, value, until)
+}
+
+func (c *staleCache) get(key string) (ByteView, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.lru.Get(key); ok {
+		return v.(ByteView), true
+	}
+	return ByteView{}, false
+}
+
+func (c *staleCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Remove(key)
+}
+
+// retainStale keep value for the grace window, it is called by the
+// caches for every entry they expire or evict
+func (g *Group) retainStale(key string, value ByteView) {
+	g.staleCache.add(key, value, time.Now().Add(g.staleGrace))
+}
+
+// serveStale return the stale value of key in place of err
+func (g *Group) serveStale(key string, err error) (ByteView, bool, error) {
+	if g.staleCache == nil || errors.Is(err, ErrNotFound) {
+		return ByteView{}, false, err
+	}
+	value, ok := g.staleCache.get(key)
+	if !ok {
+		return ByteView{}, false, err
+	}
+	g.stats.staleServes.Add(1)
+	return value, true, nil
+}
@@ -0,0 +1,229 @@
+package toyCache
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	pb "github.com/toyCache/toyCache/toycachepb"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// versionGetter return key:n where n counts the loads
+func versionGetter(loads *int32) GetterFunc {
+	return func(key string) ([]byte, error) {
+		n := atomic.AddInt32(loads, 1)
+		return []byte(key + ":" + strconv.Itoa(int(n))), nil
+	}
+}
+
+func TestSoftTTL(t *testing.T) {
+	var loads int32
+	toyC := NewGroup("softTTL", 2<<10, versionGetter(&loads), WithTTL(time.Hour), WithSoftTTL(300*time.Millisecond))
+	ctx := context.Background()
+	view, err := getView(toyC, ctx, "Tom")
+	require.NoError(t, err)
+	require.Equal(t, "Tom:1", view.String())
+
+	time.Sleep(350 * time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			view, err := getView(toyC, ctx, "Tom")
+			require.NoError(t, err)
+			require.Contains(t, []string{"Tom:1", "Tom:2"}, view.String())
+		}()
+	}
+	wg.Wait()
+	require.Eventually(t, func() bool {
+		view, _ := getView(toyC, ctx, "Tom")
+		return view.String() == "Tom:2"
+	}, time.Second, 5*time.Millisecond, "stale value should be reloaded")
+	require.Equal(t, int32(2), atomic.LoadInt32(&loads), "stale reads should trigger a single reload")
+	require.Equal(t, int64(1), toyC.Stats().Refreshes)
+	require.GreaterOrEqual(t, toyC.Stats().StaleHits, int64(1))
+}
+
+func TestSoftTTLPerKey(t *testing.T) {
+	var loads int32
+	toyC := NewGroup("softTTLPerKey", 2<<10, TTLGetterFunc(func(_ context.Context, key string) ([]byte, time.Duration, error) {
+		atomic.AddInt32(&loads, 1)
+		if key == "short" {
+			return []byte(key), 200 * time.Millisecond, nil
+		}
+		return []byte(key), 2 * time.Second, nil
+	}), WithTTL(time.Hour), WithSoftTTL(300*time.Millisecond))
+	ctx := context.Background()
+	for _, key := range []string{"short", "long"} {
+		_, err := getView(toyC, ctx, key)
+		require.NoError(t, err)
+		_, err = getView(toyC, ctx, key)
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(0), toyC.Stats().StaleHits, "values should be fresh before softTTL")
+	require.Equal(t, int32(2), atomic.LoadInt32(&loads))
+
+	time.Sleep(350 * time.Millisecond)
+	_, err := getView(toyC, ctx, "long")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), toyC.Stats().StaleHits, "value should go stale softTTL after it was loaded")
+}
+
+func TestRefreshAhead(t *testing.T) {
+	var loads int32
+	toyC := NewGroup("refreshAhead", 2<<10, versionGetter(&loads),
+		WithTTL(100*time.Millisecond), WithRefreshAhead(20*time.Millisecond, 80*time.Millisecond, 1))
+	ctx := context.Background()
+	_, err := getView(toyC, ctx, "Tom")
+	require.NoError(t, err)
+	_, err = getView(toyC, ctx, "Bob")
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = getView(toyC, ctx, "Tom")
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		view, _, _, ok := toyC.mainCache.lookup("Tom")
+		return ok && view.String() == "Tom:3"
+	}, time.Second, 5*time.Millisecond, "hot key should be refreshed before it expires")
+	require.Equal(t, int32(3), atomic.LoadInt32(&loads), "only the most read key should be refreshed")
+}
+
+// flakyGetter return the key until down is set
+func flakyGetter(down *int32) GetterFunc {
+	return func(key string) ([]byte, error) {
+		if atomic.LoadInt32(down) == 1 {
+			return nil, errors.New("connection refused")
+		}
+		if key == "Unknown" {
+			return nil, ErrNotFound
+		}
+		return []byte(key), nil
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	var down int32
+	toyC := NewGroup("staleIfError", 2<<10, flakyGetter(&down),
+		WithTTL(20*time.Millisecond), WithStaleIfError(time.Minute), WithNegativeCache(0, time.Minute))
+	ctx := context.Background()
+	for _, key := range []string{"Tom", "Bob"} {
+		_, err := getView(toyC, ctx, key)
+		require.NoError(t, err)
+	}
+	require.NoError(t, toyC.Remove(ctx, "Bob"))
+	time.Sleep(30 * time.Millisecond)
+	atomic.StoreInt32(&down, 1)
+
+	for i := 0; i < 2; i++ {
+		view, stale, err := toyC.get(ctx, "Tom")
+		require.NoError(t, err, "expired value should be served when the load fails")
+		require.True(t, stale)
+		require.Equal(t, "Tom", view.String())
+	}
+	require.Equal(t, int64(2), toyC.Stats().StaleServes, "negative hits should be served stale too")
+
+	_, err := getView(toyC, ctx, "Bob")
+	require.Error(t, err, "removed values should not be served stale")
+
+	atomic.StoreInt32(&down, 0)
+	toyC.removeLocally("Tom")
+	view, stale, err := toyC.get(ctx, "Tom")
+	require.NoError(t, err)
+	require.False(t, stale)
+	require.Equal(t, "Tom", view.String())
+}
+
+func TestStaleIfErrorFromPeer(t *testing.T) {
+	var down int32
+	owner := NewGroup("staleIfErrorPeer", 2<<10, flakyGetter(&down),
+		WithTTL(20*time.Millisecond), WithStaleIfError(time.Minute))
+	ctx := context.Background()
+	_, err := getView(owner, ctx, "Tom")
+	require.NoError(t, err)
+	time.Sleep(30 * time.Millisecond)
+	atomic.StoreInt32(&down, 1)
+
+	peer := newTestPeer(t)
+	res := &pb.Response{}
+	require.NoError(t, peer.Get(ctx, &pb.Request{Group: "staleIfErrorPeer", Key: "Tom"}, res))
+	require.True(t, res.Stale, "stale value should be flagged over the wire")
+	require.Equal(t, "Tom", string(res.Value))
+
+	requester := NewGroup("staleIfErrorRequester", 2<<10, flakyGetter(&down), WithStaleIfError(time.Minute))
+	requester.RegisterPeer(testPicker{peer: staleOwner{peer}})
+	var view ByteView
+	stale, err := requester.GetWithStale(ctx, "Tom", ByteViewSink(&view))
+	require.NoError(t, err)
+	require.True(t, stale, "requester should pass the stale flag on")
+	require.Equal(t, "Tom", view.String())
+	require.Equal(t, int64(0), requester.CacheStats(HotCache).Items, "stale values should not be cached")
+}
+
+// staleOwner asks the group of the requester as if it was staleIfErrorPeer
+type staleOwner struct {
+	*httpGetter
+}
+
+func (p staleOwner) Get(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	return p.httpGetter.Get(ctx, &pb.Request{Group: "staleIfErrorPeer", Key: in.Key}, out)
+}
+
+func (p staleOwner) GetMulti(ctx context.Context, in *pb.MultiRequest, out *pb.MultiResponse) error {
+	return p.httpGetter.GetMulti(ctx, &pb.MultiRequest{Group: "staleIfErrorPeer", Keys: in.Keys, Forwarded: true}, out)
+}
+
+func TestStaleIfErrorFromPeerMulti(t *testing.T) {
+	var down int32
+	owner := NewGroup("staleIfErrorPeer", 2<<10, flakyGetter(&down),
+		WithTTL(20*time.Millisecond), WithStaleIfError(time.Minute))
+	ctx := context.Background()
+	_, err := owner.GetMulti(ctx, []string{"Tom", "Bob"})
+	require.NoError(t, err)
+	time.Sleep(30 * time.Millisecond)
+	_, err = getView(owner, ctx, "Bob")
+	require.NoError(t, err)
+	atomic.StoreInt32(&down, 1)
+
+	peer := newTestPeer(t)
+	res := &pb.MultiResponse{}
+	require.NoError(t, peer.GetMulti(ctx, &pb.MultiRequest{Group: "staleIfErrorPeer", Keys: []string{"Tom", "Bob"}}, res))
+	require.Equal(t, []string{"Tom"}, res.Stale, "stale values should be flagged over the wire")
+	require.Equal(t, "Tom", string(res.Values["Tom"]))
+	require.Equal(t, "Bob", string(res.Values["Bob"]))
+
+	requester := NewGroup("staleIfErrorMultiRequester", 2<<10, flakyGetter(&down), WithStaleIfError(time.Minute))
+	requester.RegisterPeer(testPicker{peer: staleOwner{peer}})
+	values, stale, err := requester.GetMultiWithStale(ctx, []string{"Tom"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"Tom": true}, stale, "requester should pass the stale flag on")
+	require.Equal(t, "Tom", values["Tom"].String())
+	require.Equal(t, int64(0), requester.CacheStats(HotCache).Items, "stale values should not be cached")
+}
+
+func TestCloseStopsRefreshAhead(t *testing.T) {
+	var loads int32
+	toyC := NewGroup("refreshClose", 2<<10, versionGetter(&loads),
+		WithTTL(time.Hour), WithRefreshAhead(5*time.Millisecond, 2*time.Hour, 1))
+	ctx := context.Background()
+	_, err := getView(toyC, ctx, "Tom")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, err := getView(toyC, ctx, "Tom")
+		return err == nil && atomic.LoadInt32(&loads) > 1
+	}, time.Second, time.Millisecond, "read key should be refreshed")
+
+	require.NoError(t, toyC.Close())
+	n := atomic.LoadInt32(&loads)
+	for i := 0; i < 10; i++ {
+		_, err = getView(toyC, ctx, "Tom")
+		require.NoError(t, err)
+		time.Sleep(2 * time.Millisecond)
+	}
+	require.Equal(t, n, atomic.LoadInt32(&loads), "closed group should not refresh")
+}
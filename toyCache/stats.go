@@ -0,0 +1,63 @@
+package toyCache
+
+import "sync/atomic"
+
+// Stats are per-group statistics
+type Stats struct {
+	Gets           int64 // any Get request, including from peers
+	CacheHits      int64 // either cache was good
+	MainCacheHits  int64 // served from mainCache
+	HotCacheHits   int64 // served from hotCache
+	NegativeHits   int64 // failed with the error of a recent load
+	StaleHits      int64 // served from mainCache past the soft TTL
+	Refreshes      int64 // background reloads of stale or expiring values
+	StaleServes    int64 // failed loads answered with a stale value
+	Loads          int64 // (gets - cacheHits)
+	LoadsDeduped   int64 // after singleflight
+	PeerLoads      int64 // remote load or remote cache hit (not an error)
+	PeerErrors     int64
+	LocalLoads     int64 // total good local loads
+	LocalLoadErrs  int64 // total bad local loads
+	ServerRequests int64 // gets that came over the network from peers
+
+	RingDisagreements int64 // forwarded keys this peer does not own
+	FallbackLoads     int64 // remote loads served by the successor of a failed owner
+
+	MainCache CacheStats
+	HotCache  CacheStats
+}
+
+// groupStats hold the live counters of a Group, they are updated
+// concurrently so every access goes through atomicInt
+type groupStats struct {
+	gets           atomicInt
+	mainCacheHits  atomicInt
+	hotCacheHits   atomicInt
+	negativeHits   atomicInt
+	staleHits      atomicInt
+	refreshes      atomicInt
+	staleServes    atomicInt
+	loads          atomicInt
+	loadsDeduped   atomicInt
+	peerLoads      atomicInt
+	peerErrors     atomicInt
+	localLoads     atomicInt
+	localLoadErrs  atomicInt
+	serverRequests atomicInt
+
+	ringDisagreements atomicInt
+	fallbackLoads     atomicInt
+}
+
+// atomicInt is an int64 to be accessed atomically
+type atomicInt int64
+
+// Add atomically adds n to i
+func (i *atomicInt) Add(n int64) {
+	atomic.AddInt64((*int64)(i), n)
+}
+
+// Get atomically gets the value of i
+func (i *atomicInt) Get() int64 {
+	return atomic.LoadInt64((*int64)(i))
+}
@@ -0,0 +1,65 @@
+package tinylfu
+
+// sketch is a count-min sketch estimating how often keys were seen with
+// four rows of small counters. Every counter is halved once sampleSize
+// increments happened, so that old popularity fades away
+type sketch struct {
+	rows       [4][]uint8
+	mask       uint64
+	additions  int
+	sampleSize int
+}
+
+// maxCount is the value counters saturate at
+const maxCount = 15
+
+// newSketch create a sketch with width counters per row,
+// width is rounded up to a power of two
+func newSketch(width int) *sketch {
+	w := 1
+	for w < width {
+		w <<= 1
+	}
+	s := &sketch{mask: uint64(w - 1), sampleSize: 10 * w}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, w)
+	}
+	return s
+}
+
+func (s *sketch) index(h uint64, row int) uint64 {
+	// double hashing gives an independent enough position per row
+	return (h + uint64(row)*(h>>32|1)) & s.mask
+}
+
+func (s *sketch) increment(h uint64) {
+	for i := range s.rows {
+		if idx := s.index(h, i); s.rows[i][idx] < maxCount {
+			s.rows[i][idx]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.sampleSize {
+		s.reset()
+	}
+}
+
+func (s *sketch) estimate(h uint64) uint8 {
+	min := uint8(maxCount)
+	for i := range s.rows {
+		if v := s.rows[i][s.index(h, i)]; v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+// reset halves every counter
+func (s *sketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
@@ -0,0 +1,250 @@
+package tinylfu
+
+import (
+	"container/list"
+	"github.com/toyCache/toyCache/policy"
+	"hash/fnv"
+	"time"
+)
+
+const (
+	// windowPercent of the bytes are given to the window LRU
+	windowPercent = 1
+	// protectedPercent of the main bytes are given to the protected segment
+	protectedPercent = 80
+	// the counters per row of the frequency sketch are kept within these bounds
+	minSketchWidth = 1 << 10
+	maxSketchWidth = 1 << 20
+	// avgEntryBytes is the entry size guessed to size the sketch
+	avgEntryBytes = 64
+)
+
+// Cache is a W-TinyLFU cache. New entries go through a small window LRU,
+// entries leaving the window are only admitted into the main segmented
+// LRU when they are used more often than the entry they would evict,
+// according to a count-min sketch. It is not safe for concurrent access
+type Cache struct {
+	maxBytes       int64
+	windowBytes    int64 // budget of window
+	protectedBytes int64 // budget of protected
+	window         queue
+	probation      queue // main entries used once since admitted
+	protected      queue // main entries used again while in probation
+	cache          map[string]*entry
+	sketch         *sketch
+	expiries       policy.Expiries
+	// optional and executed when an entry is purged
+	OnEvicted func(key string, value Value)
+}
+
+type entry struct {
+	key   string
+	value Value
+	hash  uint64
+	size  int64
+	in    *queue
+	ele   *list.Element
+}
+
+// queue is a list of entries, most recent at front
+type queue struct {
+	ll    list.List
+	bytes int64
+}
+
+// Value used Len() to get how many bytes is takes
+type Value = policy.Value
+
+// New is the constructor of Cache
+func New(maxBytes int64, onEvicted func(key string, value Value)) *Cache {
+	width := int(maxBytes / avgEntryBytes)
+	if width < minSketchWidth || maxBytes == 0 {
+		width = minSketchWidth
+	} else if width > maxSketchWidth {
+		width = maxSketchWidth
+	}
+	mainBytes := maxBytes - maxBytes*windowPercent/100
+	return &Cache{
+		maxBytes:       maxBytes,
+		windowBytes:    maxBytes * windowPercent / 100,
+		protectedBytes: mainBytes * protectedPercent / 100,
+		cache:          make(map[string]*entry),
+		sketch:         newSketch(width),
+		OnEvicted:      onEvicted,
+	}
+}
+
+// Add adds a value to the cache
+func (c *Cache) Add(key string, value Value) {
+	c.AddWithExpire(key, value, time.Time{})
+}
+
+// AddWithExpire adds a value to the cache which will be treated as
+// missing after expire, a zero expire means the value never expire.
+// A new value may be rejected at once when the cache is full of more
+// frequently used ones
+func (c *Cache) AddWithExpire(key string, value Value, expire time.Time) {
+	c.RemoveExpired()
+	size := int64(value.Len()) + int64(len(key))
+	if e, ok := c.cache[key]; ok {
+		e.in.bytes += size - e.size
+		e.size, e.value = size, value
+		c.sketch.increment(e.hash)
+		c.hit(e)
+	} else {
+		e := &entry{key: key, value: value, hash: hash(key), size: size}
+		c.sketch.increment(e.hash)
+		c.cache[key] = e
+		c.push(e, &c.window)
+	}
+	c.expiries.Set(key, expire)
+	c.evict()
+}
+
+// Get look ups a key's value
+func (c *Cache) Get(key string) (value Value, ok bool) {
+	e, ok := c.cache[key]
+	if !ok {
+		// misses count too, a key asked often deserves to be admitted
+		c.sketch.increment(hash(key))
+		return nil, false
+	}
+	c.sketch.increment(e.hash)
+	if c.expiries.Expired(key, time.Now()) {
+		c.removeEntry(e)
+		return nil, false
+	}
+	c.hit(e)
+	return e.value, true
+}
+
+// Remove removes the provided key from the cache
+func (c *Cache) Remove(key string) {
+	if e, ok := c.cache[key]; ok {
+		c.removeEntry(e)
+	}
+}
+
+// RemoveExpired remove all items whose deadline has passed
+func (c *Cache) RemoveExpired() {
+	now := time.Now()
+	for key, ok := c.expiries.Next(now); ok; key, ok = c.expiries.Next(now) {
+		c.Remove(key)
+	}
+}
+
+// Deadline return the deadline of key, zero if it has none
+func (c *Cache) Deadline(key string) time.Time {
+	return c.expiries.Deadline(key)
+}
+
+// Walk calls fn for every entry, the window and probation ones before
+// the protected ones, each from the least to the most recently used
+func (c *Cache) Walk(fn func(key string, value Value, expire time.Time)) {
+	for _, q := range []*queue{&c.window, &c.probation, &c.protected} {
+		for ele := q.ll.Back(); ele != nil; ele = ele.Prev() {
+			e := ele.Value.(*entry)
+			fn(e.key, e.value, c.expiries.Deadline(e.key))
+		}
+	}
+}
+
+// Len return the number of cache entries
+func (c *Cache) Len() int {
+	return len(c.cache)
+}
+
+// Bytes return the number of bytes taken by keys and values
+func (c *Cache) Bytes() int64 {
+	return c.window.bytes + c.probation.bytes + c.protected.bytes
+}
+
+// hit moves e according to the segmented LRU, an entry used again
+// in probation is promoted to protected
+func (c *Cache) hit(e *entry) {
+	switch e.in {
+	case &c.probation:
+		c.move(e, &c.protected)
+		for c.maxBytes != 0 && c.protected.bytes > c.protectedBytes && c.protected.ll.Len() > 1 {
+			c.move(c.protected.ll.Back().Value.(*entry), &c.probation)
+		}
+	default:
+		c.move(e, e.in)
+	}
+}
+
+// evict moves the entries overflowing the window to the main segments
+// through the admission filter, then bounds the main segments
+func (c *Cache) evict() {
+	if c.maxBytes == 0 {
+		return
+	}
+	for c.window.bytes > c.windowBytes {
+		c.admit(c.window.ll.Back().Value.(*entry))
+	}
+	for c.Bytes() > c.maxBytes {
+		c.removeEntry(c.victim())
+	}
+}
+
+// admit moves candidate from the window into probation if it is used
+// more often than the main entries that must leave to make room
+func (c *Cache) admit(candidate *entry) {
+	mainBytes := c.maxBytes - c.windowBytes
+	freq := c.sketch.estimate(candidate.hash)
+	for c.probation.bytes+c.protected.bytes+candidate.size > mainBytes {
+		victim := c.victim()
+		if victim == nil {
+			break
+		}
+		if freq <= c.sketch.estimate(victim.hash) {
+			c.removeEntry(candidate)
+			return
+		}
+		c.removeEntry(victim)
+	}
+	c.move(candidate, &c.probation)
+}
+
+// victim return the least recent main entry, probation first
+func (c *Cache) victim() *entry {
+	for _, q := range []*queue{&c.probation, &c.protected, &c.window} {
+		if back := q.ll.Back(); back != nil {
+			return back.Value.(*entry)
+		}
+	}
+	return nil
+}
+
+func (c *Cache) removeEntry(e *entry) {
+	c.unlink(e)
+	delete(c.cache, e.key)
+	c.expiries.Delete(e.key)
+	if c.OnEvicted != nil {
+		c.OnEvicted(e.key, e.value)
+	}
+}
+
+func (c *Cache) push(e *entry, q *queue) {
+	e.in = q
+	e.ele = q.ll.PushFront(e)
+	q.bytes += e.size
+}
+
+func (c *Cache) unlink(e *entry) {
+	e.in.ll.Remove(e.ele)
+	e.in.bytes -= e.size
+}
+
+func (c *Cache) move(e *entry, q *queue) {
+	c.unlink(e)
+	c.push(e, q)
+}
+
+func hash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+var _ policy.Policy = (*Cache)(nil)
@@ -0,0 +1,128 @@
+package tinylfu
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type String string
+
+func (d String) Len() int {
+	return len(d)
+}
+
+func TestCache_Get(t *testing.T) {
+	lfu := New(int64(0), nil)
+	lfu.Add("key1", String("123"))
+	if v, ok := lfu.Get("key1"); !ok || v.Len() != 3 {
+		t.Fatalf("cache hit key1=123 failed")
+	}
+	if _, ok := lfu.Get("key2"); ok {
+		t.Fatalf("cache miss key2 failed")
+	}
+}
+
+func TestCache_Add(t *testing.T) {
+	lfu := New(int64(0), nil)
+	lfu.Add("key", String("123"))
+	lfu.Add("key", String("1234"))
+	if lfu.Bytes() != int64(len("key")+len("1234")) {
+		t.Fatal("expected 7 but got", lfu.Bytes())
+	}
+}
+
+func TestCache_Remove(t *testing.T) {
+	lfu := New(int64(1000), nil)
+	lfu.Add("key1", String("123"))
+	lfu.Add("key2", String("456"))
+	lfu.Get("key2")
+	lfu.Remove("key1")
+	lfu.Remove("key2")
+	if lfu.Len() != 0 || lfu.Bytes() != 0 {
+		t.Fatalf("remove all keys failed")
+	}
+}
+
+func TestCache_OnEvicted(t *testing.T) {
+	keys := make([]string, 0)
+	OnEvicted := func(key string, value Value) {
+		keys = append(keys, key)
+	}
+	lfu := New(int64(10), OnEvicted)
+
+	lfu.Add("key1", String("12345"))
+	lfu.Get("key1")
+	// key2 is seen less often than key1, it is not admitted
+	lfu.Add("key2", String("12345"))
+	expect := []string{"key2"}
+
+	if !reflect.DeepEqual(keys, expect) {
+		t.Fatalf("Called OnEvicted failed, expect keys %s, but got %s", expect, keys)
+	}
+}
+
+func TestCache_ScanResistance(t *testing.T) {
+	// room for 100 entries of 10 bytes
+	lfu := New(int64(1000), nil)
+	hot := make([]string, 50)
+	for i := range hot {
+		hot[i] = fmt.Sprintf("hot%02d", i)
+		lfu.Add(hot[i], String("12345"))
+		for j := 0; j < 3; j++ {
+			lfu.Get(hot[i])
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		lfu.Add(fmt.Sprintf("scan%03d", i), String("123"))
+	}
+	for _, key := range hot {
+		if _, ok := lfu.Get(key); !ok {
+			t.Fatalf("hot key %s was flushed by a scan", key)
+		}
+	}
+	if lfu.Bytes() > 1000 {
+		t.Fatalf("expected at most 1000 bytes but got %d", lfu.Bytes())
+	}
+}
+
+func TestCache_Expire(t *testing.T) {
+	lfu := New(int64(0), nil)
+	lfu.AddWithExpire("key1", String("123"), time.Now().Add(10*time.Millisecond))
+	lfu.Add("key2", String("456"))
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := lfu.Get("key1"); ok {
+		t.Fatalf("expired key1 should be a miss")
+	}
+	lfu.AddWithExpire("key3", String("789"), time.Now().Add(-time.Millisecond))
+	lfu.RemoveExpired()
+	if _, ok := lfu.Get("key2"); !ok || lfu.Len() != 1 {
+		t.Fatalf("key2 without deadline should not expire")
+	}
+}
+
+func TestSketch(t *testing.T) {
+	s := newSketch(16)
+	if len(s.rows[0]) != 16 {
+		t.Fatalf("expected width 16 but got %d", len(s.rows[0]))
+	}
+	h1, h2 := hash("key1"), hash("key2")
+	for i := 0; i < 5; i++ {
+		s.increment(h1)
+	}
+	s.increment(h2)
+	if got := s.estimate(h1); got < 5 {
+		t.Fatalf("estimate of key1 expect at least 5 but got %d", got)
+	}
+	s.reset()
+	if got := s.estimate(h1); got > 3 {
+		t.Fatalf("estimate of key1 after reset expect at most 3 but got %d", got)
+	}
+	for i := 0; i < 100; i++ {
+		s.increment(h2)
+	}
+	if got := s.estimate(h2); got > maxCount {
+		t.Fatalf("counter should saturate at %d but got %d", maxCount, got)
+	}
+}
@@ -1,36 +1,182 @@
 package toyCache
 
 import (
+	"context"
 	"errors"
+	"github.com/toyCache/toyCache/disk"
 	"github.com/toyCache/toyCache/singleflight"
 	pb "github.com/toyCache/toyCache/toycachepb"
 	"log"
+	"math/rand"
 	"sync"
+	"time"
 )
 
 // Group is a cache namespace and associate data load
 type Group struct {
 	name      string
 	getter    Getter
-	mainCache cache
+	mainCache *shardedCache
 	peers     PeerPicker
+	fallback  FallbackPolicy
+
+	// hotCache contains values owned by remote peers that are
+	// fetched often enough to be worth a local copy
+	hotCache cache
+	ttl      time.Duration // zero means values never expire
+	policy   EvictionPolicy
+	shards   int
+
+	// negCache remembers failed loads, nil unless WithNegativeCache
+	negCache    *negativeCache
+	notFoundTTL time.Duration
+	errTTL      time.Duration
+
+	diskDir   string
+	diskBytes int64
+
+	snapshotPath     string
+	snapshotInterval time.Duration
+
+	// softTTL marks values stale before they expire, refreshing holds
+	// the keys reloaded in the background
+	softTTL    time.Duration
+	refreshing sync.Map
+
+	// staleCache keeps values past their life for staleGrace,
+	// nil unless WithStaleIfError
+	staleCache *staleCache
+	staleGrace time.Duration
+
+	// access counts reads of mainCache, nil unless WithRefreshAhead
+	access          *accessCounter
+	refreshInterval time.Duration
+	refreshAhead    time.Duration
+	refreshTopN     int
 
 	// loadGroup make sure that each key fetched once
 	// either in locally or remote
-	loadGroup *singleflight.Group
+	loadGroup   *singleflight.Group
+	loadTimeout time.Duration
+
+	// done is closed by Close to stop the background goroutines,
+	// background waits for them to exit. closeMu orders the goroutines
+	// started on demand with the close of done
+	done       chan struct{}
+	closeOnce  sync.Once
+	closeMu    sync.Mutex
+	background sync.WaitGroup
+
+	stats groupStats
 }
 
-// Getter load data for a key
+// Getter load data for a key into dest, ctx carries the deadline
+// and request-scoped values of the caller that triggered the load
 type Getter interface {
-	Get(key string) ([]byte, error)
+	Get(ctx context.Context, key string, dest Sink) error
 }
 
-// GetterFunc implements Getter with a function
+// GetterFunc adapts a function that does not need a context to Getter
 type GetterFunc func(key string) ([]byte, error)
 
 // Get implements Getter interface function
-func (f GetterFunc) Get(key string) ([]byte, error) {
-	return f(key)
+func (f GetterFunc) Get(_ context.Context, key string, dest Sink) error {
+	bytes, err := f(key)
+	if err != nil {
+		return err
+	}
+	return dest.SetBytes(bytes)
+}
+
+// ContextGetterFunc implements Getter with a function returning bytes
+type ContextGetterFunc func(ctx context.Context, key string) ([]byte, error)
+
+// Get implements Getter interface function
+func (f ContextGetterFunc) Get(ctx context.Context, key string, dest Sink) error {
+	bytes, err := f(ctx, key)
+	if err != nil {
+		return err
+	}
+	return dest.SetBytes(bytes)
+}
+
+// SinkGetterFunc implements Getter with a function writing into dest
+type SinkGetterFunc func(ctx context.Context, key string, dest Sink) error
+
+// Get implements Getter interface function
+func (f SinkGetterFunc) Get(ctx context.Context, key string, dest Sink) error {
+	return f(ctx, key, dest)
+}
+
+// TTLGetter is optionally implemented by a Getter to override
+// the group TTL for a single key, a zero ttl means never expire
+type TTLGetter interface {
+	GetWithTTL(ctx context.Context, key string, dest Sink) (time.Duration, error)
+}
+
+// TTLGetterFunc implements Getter and TTLGetter with a function
+type TTLGetterFunc func(ctx context.Context, key string) ([]byte, time.Duration, error)
+
+// Get implements Getter interface function
+func (f TTLGetterFunc) Get(ctx context.Context, key string, dest Sink) error {
+	_, err := f.GetWithTTL(ctx, key, dest)
+	return err
+}
+
+// GetWithTTL implements TTLGetter interface function
+func (f TTLGetterFunc) GetWithTTL(ctx context.Context, key string, dest Sink) (time.Duration, error) {
+	bytes, ttl, err := f(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	return ttl, dest.SetBytes(bytes)
+}
+
+// GroupOption configures a Group created by NewGroup
+type GroupOption func(*Group)
+
+// WithTTL make values loaded by the group expire after ttl,
+// expired values are treated as misses and loaded again
+func WithTTL(ttl time.Duration) GroupOption {
+	return func(g *Group) {
+		g.ttl = ttl
+	}
+}
+
+// WithLoadTimeout bound the loads of the group, a load is shared by
+// the callers of a key so it does not end with the ctx of one of them
+func WithLoadTimeout(timeout time.Duration) GroupOption {
+	return func(g *Group) {
+		g.loadTimeout = timeout
+	}
+}
+
+// WithEvictionPolicy make the caches of the group evict with p
+// instead of LRU
+func WithEvictionPolicy(p EvictionPolicy) GroupOption {
+	return func(g *Group) {
+		g.policy = p
+	}
+}
+
+// WithShards split the main cache of the group into n independently
+// locked shards, each holding 1/n of its bytes. It is opt-in because
+// each shard evicts on its own, so a small cache loses keys before it
+// is full and the eviction order is no longer global
+func WithShards(n int) GroupOption {
+	return func(g *Group) {
+		g.shards = n
+	}
+}
+
+// WithDiskTier add a disk tier under the main cache, the entries it
+// evicts are kept in dir up to maxBytes and promoted back when read.
+// Zero maxBytes means unbounded, Close releases the files
+func WithDiskTier(dir string, maxBytes int64) GroupOption {
+	return func(g *Group) {
+		g.diskDir = dir
+		g.diskBytes = maxBytes
+	}
 }
 
 var (
@@ -38,20 +184,66 @@ var (
 	groups = make(map[string]*Group)
 )
 
+const (
+	// hotCacheRatio is the part of the group cacheBytes given to hotCache
+	hotCacheRatio = 8
+	// defaultLoadTimeout bounds a load shared by the callers of a key
+	defaultLoadTimeout = 30 * time.Second
+)
+
+// hotCacheOdds means one of every hotCacheOdds values fetched from
+// peers is populated into hotCache
+var hotCacheOdds = 10
+
 // NewGroup create an instance of Group
-func NewGroup(name string, cacheByte int64, getter Getter) *Group {
+func NewGroup(name string, cacheByte int64, getter Getter, opts ...GroupOption) *Group {
 	if getter == nil {
 		panic("nil Getter")
 	}
-	mu.Lock()
-	defer mu.Unlock()
 	g := &Group{
 		name:      name,
 		getter:    getter,
-		mainCache: cache{cacheBytes: cacheByte},
 		loadGroup: &singleflight.Group{},
+		shards:    1,
+		done:      make(chan struct{}),
+
+		loadTimeout: defaultLoadTimeout,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	hotBytes, mainBytes := share(cacheByte, hotCacheRatio), cacheByte
+	if mainBytes > hotBytes {
+		mainBytes -= hotBytes
+	}
+	g.mainCache = newShardedCache(g.shards, mainBytes, g.policy)
+	g.hotCache = cache{cacheBytes: hotBytes, policy: g.policy}
+	if g.diskDir != "" {
+		if l2, err := disk.Open(g.diskDir, g.diskBytes); err != nil {
+			log.Println("[toyCache] Failed to open disk tier", err)
+		} else {
+			g.mainCache.setDiskTier(l2)
+		}
+	}
+	if g.staleGrace > 0 {
+		g.staleCache = newStaleCache(share(cacheByte, staleCacheRatio))
+		g.mainCache.setRetain(g.retainStale)
+		g.hotCache.retain = g.retainStale
 	}
+	if g.notFoundTTL > 0 || g.errTTL > 0 {
+		g.negCache = newNegativeCache(share(cacheByte, negativeCacheRatio))
+	}
+	if g.refreshInterval > 0 && g.refreshTopN > 0 {
+		g.startRefreshAhead()
+	}
+	mu.Lock()
 	groups[name] = g
+	mu.Unlock()
+	// the snapshot is read without mu held, a slow disk must not
+	// block the other groups
+	if g.snapshotPath != "" {
+		g.startSnapshots()
+	}
 	return g
 }
 
@@ -71,59 +263,359 @@ func (g *Group) RegisterPeer(picker PeerPicker) {
 	g.peers = picker
 }
 
-// Get return value for a key in cache
-func (g *Group) Get(key string) (ByteView, error) {
+// Close stop the background work of the group, the snapshot and
+// refresh-ahead tickers, and close its disk tier. The group can still
+// be used after Close, from memory only
+func (g *Group) Close() error {
+	var err error
+	g.closeOnce.Do(func() {
+		g.closeMu.Lock()
+		close(g.done)
+		g.closeMu.Unlock()
+		g.background.Wait()
+		err = g.mainCache.closeDiskTier()
+	})
+	return err
+}
+
+// Get return value for a key in cache into dest, a stale value
+// served by WithStaleIfError is returned without error. Use
+// GetWithStale to tell it from a fresh one
+func (g *Group) Get(ctx context.Context, key string, dest Sink) error {
+	_, err := g.GetWithStale(ctx, key, dest)
+	return err
+}
+
+// GetWithStale is Get that also report whether the value is a stale
+// one served in place of a load error, see WithStaleIfError
+func (g *Group) GetWithStale(ctx context.Context, key string, dest Sink) (stale bool, err error) {
+	if dest == nil {
+		return false, errors.New("nil dest Sink")
+	}
+	value, stale, err := g.get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	return stale, setSinkView(dest, value)
+}
+
+// get return the value of key, stale is set when it is a value
+// served in place of a load error, see WithStaleIfError
+func (g *Group) get(ctx context.Context, key string) (value ByteView, stale bool, err error) {
 	if key == "" {
-		return ByteView{}, errors.New("require key")
+		return ByteView{}, false, errors.New("require key")
+	}
+	g.stats.gets.Add(1)
+	if v, ok := g.lookupCache(key); ok {
+		return v, false, nil
 	}
-	if v, ok := g.mainCache.get(key); ok {
-		return v, nil
+	if err, ok := g.lookupNegative(key); ok {
+		return g.serveStale(key, err)
 	}
 
 	// call Getter
-	return g.load(key)
+	if value, err = g.load(ctx, key); err != nil {
+		return g.serveStale(key, err)
+	}
+	return value, false, nil
 }
 
-func (g *Group) getLocally(key string) (ByteView, error) {
-	bytes, err := g.getter.Get(key)
+// Remove evicts key from the group, if the key is owned by a remote
+// peer the invalidation is sent to it first
+func (g *Group) Remove(ctx context.Context, key string) error {
+	if key == "" {
+		return errors.New("require key")
+	}
+	if replicas := g.replicas(key); len(replicas) > 0 {
+		err := g.eachReplica(replicas, func(peer PeerGetter) error {
+			return g.removeFromPeer(ctx, peer, key)
+		})
+		g.removeLocally(key)
+		return err
+	}
+	if g.peers != nil {
+		if peer, ok := g.peers.PickPeer(key); ok {
+			if err := g.removeFromPeer(ctx, peer, key); err != nil {
+				return err
+			}
+		}
+	}
+	g.removeLocally(key)
+	return nil
+}
+
+// Set stores value for key in the cache of its owner, so the next Get
+// is served without calling the Getter. The caller should write the
+// backing store first, the value is a cache entry only
+func (g *Group) Set(ctx context.Context, key string, value []byte) error {
+	if key == "" {
+		return errors.New("require key")
+	}
+	if replicas := g.replicas(key); len(replicas) > 0 {
+		req := &pb.SetRequest{Group: g.name, Key: key, Value: value}
+		err := g.eachReplica(replicas, func(peer PeerGetter) error {
+			return peer.Set(ctx, req, &pb.SetResponse{})
+		})
+		if isReplica(replicas) {
+			g.setLocally(key, value)
+		} else {
+			g.removeLocally(key)
+		}
+		return err
+	}
+	if g.peers != nil {
+		if peer, ok := g.peers.PickPeer(key); ok {
+			req := &pb.SetRequest{Group: g.name, Key: key, Value: value}
+			if err := peer.Set(ctx, req, &pb.SetResponse{}); err != nil {
+				return err
+			}
+			// drop the stale local copy, the owner holds the new value
+			g.removeLocally(key)
+			return nil
+		}
+	}
+	g.setLocally(key, value)
+	return nil
+}
+
+func (g *Group) setLocally(key string, value []byte) {
+	g.hotCache.remove(key)
+	g.populateCache(key, ByteView{b: cloneBytes(value)}, g.mainCache, g.ttl)
+}
+
+func (g *Group) removeLocally(key string) {
+	g.mainCache.remove(key)
+	g.hotCache.remove(key)
+	if g.negCache != nil {
+		g.negCache.remove(key)
+	}
+	if g.staleCache != nil {
+		g.staleCache.remove(key)
+	}
+}
+
+func (g *Group) lookupCache(key string) (ByteView, bool) {
+	if v, expire, soft, ok := g.mainCache.lookup(key); ok {
+		g.stats.mainCacheHits.Add(1)
+		if g.access != nil {
+			g.access.hit(key, expire)
+		}
+		if isStale(soft) {
+			g.stats.staleHits.Add(1)
+			g.refresh(key)
+		}
+		return v, true
+	}
+	if v, ok := g.hotCache.get(key); ok {
+		g.stats.hotCacheHits.Add(1)
+		return v, true
+	}
+	return ByteView{}, false
+}
+
+func (g *Group) getLocally(ctx context.Context, key string) (ByteView, error) {
+	var (
+		value ByteView
+		err   error
+		ttl   = g.ttl
+	)
+	dest := ByteViewSink(&value)
+	if tg, ok := g.getter.(TTLGetter); ok {
+		ttl, err = tg.GetWithTTL(ctx, key, dest)
+	} else {
+		err = g.getter.Get(ctx, key, dest)
+	}
 	if err != nil {
+		g.stats.localLoadErrs.Add(1)
 		return ByteView{}, err
 	}
-	value := ByteView{b: cloneBytes(bytes)}
-	g.populateCache(key, value)
+	g.stats.localLoads.Add(1)
+	g.populateCache(key, value, g.mainCache, ttl)
 	return value, nil
 }
 
-func (g *Group) getFromPeer(peer PeerGetter, key string)(ByteView, error) {
-	req := &pb.Request{Group: g.name, Key: key}
+func (g *Group) getFromPeer(ctx context.Context, peer PeerGetter, key string) (ByteView, error) {
+	return g.requestPeer(ctx, peer, &pb.Request{Group: g.name, Key: key, Forwarded: true})
+}
+
+func (g *Group) requestPeer(ctx context.Context, peer PeerGetter, req *pb.Request) (ByteView, error) {
+	key := req.GetKey()
 	res := &pb.Response{}
-	err := peer.Get(req, res)
+	err := peer.Get(ctx, req, res)
 	if err != nil {
 		return ByteView{}, err
 	}
-	return ByteView{b: res.Value}, nil
+	value := ByteView{b: res.Value}
+	if res.Stale {
+		// keep it in case the local Getter fails too
+		if g.staleCache != nil {
+			g.staleCache.add(key, value, time.Now().Add(g.staleGrace))
+		}
+		return ByteView{}, errStale
+	}
+	g.populateHotCache(key, value)
+	return value, nil
 }
 
-func (g *Group) populateCache(key string, value ByteView) {
-	g.mainCache.add(key, value)
+// populateHotCache keep a copy of one of every hotCacheOdds values
+// fetched from peers
+func (g *Group) populateHotCache(key string, value ByteView) {
+	if rand.Intn(hotCacheOdds) == 0 {
+		g.populateCache(key, value, &g.hotCache, g.ttl)
+	}
 }
 
-func (g *Group) load(key string) (value ByteView, err error) {
-	// each key only fetched once regardless of the number of concurrent caller
-	view, err := g.loadGroup.Do(key, func() (interface{}, error) {
-		if g.peers != nil {
-			if peer, ok := g.peers.PickPeer(key); ok{
-				if value, err = g.getFromPeer(peer, key); err == nil {
-					return value, nil
-				}
-				log.Println("[toyCache] Failed to get from peer", err)
-			}
+func (g *Group) removeFromPeer(ctx context.Context, peer PeerGetter, key string) error {
+	req := &pb.Request{Group: g.name, Key: key}
+	return peer.Delete(ctx, req, &pb.DeleteResponse{})
+}
+
+func (g *Group) populateCache(key string, value ByteView, cache localCache, ttl time.Duration) {
+	var expire, soft time.Time
+	if ttl > 0 {
+		now := time.Now()
+		expire = now.Add(ttl)
+		// ttl may come from a TTLGetter, the value only goes
+		// stale when it lives longer than softTTL
+		if g.softTTL > 0 && g.softTTL < ttl {
+			soft = now.Add(g.softTTL)
 		}
-		return g.getLocally(key)
+	}
+	cache.add(key, value, expire, soft)
+	if g.negCache != nil {
+		g.negCache.remove(key)
+	}
+}
+
+// CacheType represent a type of cache
+type CacheType int
+
+const (
+	// MainCache is the cache for items that this peer is the owner for
+	MainCache CacheType = iota + 1
+
+	// HotCache is the cache for items that seem popular enough to
+	// replicate to this node, even though it's not the owner
+	HotCache
+)
+
+// Stats return a snapshot of the group statistics,
+// it is safe to call concurrently with Get
+func (g *Group) Stats() Stats {
+	s := Stats{
+		Gets:           g.stats.gets.Get(),
+		MainCacheHits:  g.stats.mainCacheHits.Get(),
+		HotCacheHits:   g.stats.hotCacheHits.Get(),
+		NegativeHits:   g.stats.negativeHits.Get(),
+		StaleServes:    g.stats.staleServes.Get(),
+		StaleHits:      g.stats.staleHits.Get(),
+		Refreshes:      g.stats.refreshes.Get(),
+		Loads:          g.stats.loads.Get(),
+		LoadsDeduped:   g.stats.loadsDeduped.Get(),
+		PeerLoads:      g.stats.peerLoads.Get(),
+		PeerErrors:     g.stats.peerErrors.Get(),
+		LocalLoads:     g.stats.localLoads.Get(),
+		LocalLoadErrs:  g.stats.localLoadErrs.Get(),
+		ServerRequests: g.stats.serverRequests.Get(),
+		MainCache:      g.mainCache.stats(),
+		HotCache:       g.hotCache.stats(),
+
+		RingDisagreements: g.stats.ringDisagreements.Get(),
+		FallbackLoads:     g.stats.fallbackLoads.Get(),
+	}
+	s.CacheHits = s.MainCacheHits + s.HotCacheHits
+	return s
+}
+
+// CacheStats return stats about the provided cache within the group
+func (g *Group) CacheStats(which CacheType) CacheStats {
+	switch which {
+	case MainCache:
+		return g.mainCache.stats()
+	case HotCache:
+		return g.hotCache.stats()
+	default:
+		return CacheStats{}
+	}
+}
+
+func (g *Group) load(ctx context.Context, key string) (ByteView, error) {
+	if err := ctx.Err(); err != nil {
+		// nobody is left to wait for the load
+		return ByteView{}, err
+	}
+	g.stats.loads.Add(1)
+	// each key only fetched once regardless of the number of concurrent caller.
+	// The load is shared, so it runs on its own ctx and a caller giving up
+	// only ends its own wait
+	ch := g.loadGroup.DoChan(key, func() (interface{}, error) {
+		g.stats.loadsDeduped.Add(1)
+		loadCtx, cancel := context.WithTimeout(detachedContext{ctx}, g.loadTimeout)
+		defer cancel()
+		value, err := g.loadShared(loadCtx, key)
+		if err != nil {
+			return nil, err
+		}
+		return value, nil
 	})
-	if err == nil {
-		return view.(ByteView), nil
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return ByteView{}, res.Err
+		}
+		return res.Val.(ByteView), nil
+	case <-ctx.Done():
+		return ByteView{}, ctx.Err()
+	}
+}
+
+// loadShared fetch key from its owner, or with the Getter
+func (g *Group) loadShared(ctx context.Context, key string) (ByteView, error) {
+	if replicas := g.replicas(key); len(replicas) > 0 {
+		return g.loadFromReplicas(ctx, key, replicas)
+	}
+	// an owner ejected by its breaker is not picked, ask its successor
+	peer, ok := g.pickPeer(ctx, key)
+	unreachable := !ok
+	if ok {
+		value, err := g.getFromPeer(ctx, peer, key)
+		if err == nil {
+			g.stats.peerLoads.Add(1)
+			return value, nil
+		}
+		if errors.Is(err, ErrNotFound) {
+			// the owner already asked its Getter, don't ask again
+			g.stats.peerLoads.Add(1)
+			g.populateNegative(key, err)
+			return ByteView{}, err
+		}
+		g.stats.peerErrors.Add(1)
+		log.Println("[toyCache] Failed to get from peer", err)
+		unreachable = ownerUnreachable(err)
+	}
+	if unreachable {
+		if value, ok, err := g.loadFromFallback(ctx, key, peer); ok {
+			return value, err
+		}
 	}
-	return
+	value, err := g.getLocally(ctx, key)
+	if err != nil {
+		g.populateNegative(key, err)
+		return ByteView{}, err
+	}
+	return value, nil
 }
 
+// detachedContext keeps the values of its parent but not its
+// cancellation, a shared load must not fail with the ctx of one caller
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
@@ -1,10 +1,17 @@
 package toyCache
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/require"
+	pb "github.com/toyCache/toyCache/toycachepb"
 	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var db = map[string]string{
@@ -18,10 +25,18 @@ func TestGetter(t *testing.T) {
 		return []byte(key), nil
 	})
 	expect := []byte("key")
-	v, _ := f.Get("key")
+	var v []byte
+	require.NoError(t, f.Get(context.Background(), "key", AllocatingByteSliceSink(&v)))
 	require.Equal(t, expect, v)
 }
 
+// getView is Group.Get into a ByteView
+func getView(g *Group, ctx context.Context, key string) (ByteView, error) {
+	var view ByteView
+	err := g.Get(ctx, key, ByteViewSink(&view))
+	return view, err
+}
+
 func TestGet(t *testing.T) {
 	loadCounts := make(map[string]int, len(db))
 	toyC := NewGroup("score", 2<<10, GetterFunc(func(key string) ([]byte, error) {
@@ -37,10 +52,10 @@ func TestGet(t *testing.T) {
 	}))
 
 	for k, v := range db {
-		view, err := toyC.Get(k)
+		view, err := getView(toyC, context.Background(), k)
 		require.NoError(t, err)
 		require.Equal(t, view.String(), v)
-		_, err = toyC.Get(k)
+		_, err = getView(toyC, context.Background(), k)
 		require.NoError(t, err)
 		require.True(t, loadCounts[k] == 1, fmt.Errorf("cache %s miss", k))
 	}
@@ -57,3 +72,493 @@ func TestGetGroup(t *testing.T) {
 	group = GetGroup(groupName + "invalid")
 	require.Empty(t, group)
 }
+
+func TestGetTTL(t *testing.T) {
+	loads := 0
+	toyC := NewGroup("ttl", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}), WithTTL(10*time.Millisecond))
+
+	_, err := getView(toyC, context.Background(), "Tom")
+	require.NoError(t, err)
+	_, err = getView(toyC, context.Background(), "Tom")
+	require.NoError(t, err)
+	require.Equal(t, 1, loads, "value should be cached before ttl")
+
+	time.Sleep(20 * time.Millisecond)
+	_, err = getView(toyC, context.Background(), "Tom")
+	require.NoError(t, err)
+	require.Equal(t, 2, loads, "expired value should be loaded again")
+}
+
+func TestGetTTLOverride(t *testing.T) {
+	loads := make(map[string]int)
+	toyC := NewGroup("ttlOverride", 2<<10, TTLGetterFunc(func(_ context.Context, key string) ([]byte, time.Duration, error) {
+		loads[key]++
+		if key == "short" {
+			return []byte(key), 10 * time.Millisecond, nil
+		}
+		return []byte(key), 0, nil
+	}), WithTTL(time.Millisecond))
+
+	for _, k := range []string{"short", "forever"} {
+		_, err := getView(toyC, context.Background(), k)
+		require.NoError(t, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	for _, k := range []string{"short", "forever"} {
+		_, err := getView(toyC, context.Background(), k)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, loads["short"])
+	require.Equal(t, 1, loads["forever"])
+}
+
+type testPeer struct {
+	gets    int
+	deleted []string
+	set     []string
+}
+
+func (p *testPeer) Get(_ context.Context, in *pb.Request, out *pb.Response) error {
+	p.gets++
+	out.Value = []byte("peer:" + in.Key)
+	return nil
+}
+
+func (p *testPeer) Delete(_ context.Context, in *pb.Request, out *pb.DeleteResponse) error {
+	p.deleted = append(p.deleted, in.Key)
+	return nil
+}
+
+func (p *testPeer) Set(_ context.Context, in *pb.SetRequest, out *pb.SetResponse) error {
+	p.set = append(p.set, in.Key+"="+string(in.Value))
+	return nil
+}
+
+type testPicker struct {
+	peer PeerGetter
+}
+
+func (p testPicker) PickPeer(key string) (PeerGetter, bool) {
+	return p.peer, p.peer != nil
+}
+
+func TestRemove(t *testing.T) {
+	loads := 0
+	toyC := NewGroup("remove", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}))
+	_, err := getView(toyC, context.Background(), "Tom")
+	require.NoError(t, err)
+	require.NoError(t, toyC.Remove(context.Background(), "Tom"))
+	_, err = getView(toyC, context.Background(), "Tom")
+	require.NoError(t, err)
+	require.Equal(t, 2, loads, "removed key should be loaded again")
+
+	peer := &testPeer{}
+	toyC.RegisterPeer(testPicker{peer: peer})
+	require.NoError(t, toyC.Remove(context.Background(), "Tom"))
+	require.Equal(t, []string{"Tom"}, peer.deleted)
+}
+
+func TestSet(t *testing.T) {
+	loads := 0
+	toyC := NewGroup("set", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte("db:" + key), nil
+	}))
+	ctx := context.Background()
+	require.NoError(t, toyC.Set(ctx, "Tom", []byte("630")))
+	view, err := getView(toyC, ctx, "Tom")
+	require.NoError(t, err)
+	require.Equal(t, "630", view.String())
+	require.Equal(t, 0, loads, "set key should not be loaded")
+
+	peer := &testPeer{}
+	toyC.RegisterPeer(testPicker{peer: peer})
+	require.NoError(t, toyC.Set(ctx, "Tom", []byte("631")))
+	require.Equal(t, []string{"Tom=631"}, peer.set)
+	require.Equal(t, int64(0), toyC.CacheStats(MainCache).Items, "value should be stored by the owner only")
+}
+
+func TestHotCache(t *testing.T) {
+	defer func(odds int) { hotCacheOdds = odds }(hotCacheOdds)
+	hotCacheOdds = 1
+
+	toyC := NewGroup("hot", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return nil, fmt.Errorf("key: %s should be loaded from peer", key)
+	}))
+	peer := &testPeer{}
+	toyC.RegisterPeer(testPicker{peer: peer})
+	for i := 0; i < 3; i++ {
+		view, err := getView(toyC, context.Background(), "Tom")
+		require.NoError(t, err)
+		require.Equal(t, "peer:Tom", view.String())
+	}
+	require.Equal(t, 1, peer.gets, "hot key should be served from hotCache")
+
+	stats := toyC.CacheStats(HotCache)
+	require.Equal(t, int64(1), stats.Items)
+	require.Equal(t, int64(2), stats.Hits)
+	require.Equal(t, int64(0), toyC.CacheStats(MainCache).Items)
+
+	require.NoError(t, toyC.Remove(context.Background(), "Tom"))
+	require.Equal(t, int64(0), toyC.CacheStats(HotCache).Items)
+}
+
+type ctxKey struct{}
+
+func TestGetContext(t *testing.T) {
+	toyC := NewGroup("context", 2<<10, ContextGetterFunc(func(ctx context.Context, key string) ([]byte, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return []byte(ctx.Value(ctxKey{}).(string)), nil
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := getView(toyC, ctx, "Tom")
+	require.ErrorIs(t, err, context.Canceled)
+
+	ctx = context.WithValue(context.Background(), ctxKey{}, "trace-1")
+	view, err := getView(toyC, ctx, "Tom")
+	require.NoError(t, err)
+	require.Equal(t, "trace-1", view.String())
+}
+
+func TestStats(t *testing.T) {
+	toyC := NewGroup("stats", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		if v, ok := db[key]; ok {
+			return []byte(v), nil
+		}
+		return nil, fmt.Errorf("key: %s not exist", key)
+	}))
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := getView(toyC, ctx, "Tom")
+		require.NoError(t, err)
+	}
+	_, err := getView(toyC, ctx, "Unknown")
+	require.Error(t, err)
+
+	stats := toyC.Stats()
+	require.Equal(t, int64(4), stats.Gets)
+	require.Equal(t, int64(2), stats.CacheHits)
+	require.Equal(t, int64(2), stats.MainCacheHits)
+	require.Equal(t, int64(2), stats.Loads)
+	require.Equal(t, int64(2), stats.LoadsDeduped)
+	require.Equal(t, int64(1), stats.LocalLoads)
+	require.Equal(t, int64(1), stats.LocalLoadErrs)
+	require.Equal(t, int64(1), stats.MainCache.Items)
+	require.Equal(t, int64(len("Tom")+len(db["Tom"])), stats.MainCache.Bytes)
+}
+
+func TestEvictions(t *testing.T) {
+	toyC := NewGroup("evictions", 64, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}), WithTTL(20*time.Millisecond))
+	ctx := context.Background()
+	_, err := getView(toyC, ctx, "Tom")
+	require.NoError(t, err)
+	require.NoError(t, toyC.Remove(ctx, "Tom"))
+	_, err = getView(toyC, ctx, "Tom")
+	require.NoError(t, err)
+	time.Sleep(30 * time.Millisecond)
+	_, err = getView(toyC, ctx, "Tom")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), toyC.CacheStats(MainCache).Evictions, "removed and expired values are not evictions")
+
+	for i := 0; i < 20; i++ {
+		_, err = getView(toyC, ctx, "key"+strconv.Itoa(i))
+		require.NoError(t, err)
+	}
+	require.NotZero(t, toyC.CacheStats(MainCache).Evictions)
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	for name, p := range map[string]EvictionPolicy{"LRU": LRU, "LFU": LFU, "ARC": ARC, "TinyLFU": TinyLFU} {
+		loads := 0
+		toyC := NewGroup("policy"+name, 2<<10, GetterFunc(func(key string) ([]byte, error) {
+			loads++
+			return []byte(key), nil
+		}), WithEvictionPolicy(p))
+		for i := 0; i < 2; i++ {
+			view, err := getView(toyC, context.Background(), "Tom")
+			require.NoError(t, err)
+			require.Equal(t, "Tom", view.String())
+		}
+		require.Equal(t, 1, loads, "%s should cache Tom", name)
+		require.Equal(t, int64(1), toyC.CacheStats(MainCache).Items)
+	}
+}
+
+func TestShards(t *testing.T) {
+	toyC := NewGroup("shards", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}), WithShards(4))
+	require.Len(t, toyC.mainCache.shards, 4)
+	for i := 0; i < 20; i++ {
+		_, err := getView(toyC, context.Background(), strconv.Itoa(i))
+		require.NoError(t, err)
+	}
+	used := 0
+	for i := range toyC.mainCache.shards {
+		if toyC.mainCache.shards[i].stats().Items > 0 {
+			used++
+		}
+	}
+	require.Greater(t, used, 1, "keys should spread over shards")
+	require.Equal(t, int64(20), toyC.CacheStats(MainCache).Items)
+}
+
+func TestShardBytes(t *testing.T) {
+	var sizes []int64
+	c := newShardedCache(4, 10, nil)
+	for i := range c.shards {
+		sizes = append(sizes, c.shards[i].cacheBytes)
+	}
+	require.Equal(t, []int64{3, 3, 2, 2}, sizes, "remainder should go to the first shards")
+	c = newShardedCache(4, 2, nil)
+	for i := range c.shards {
+		require.Equal(t, int64(1), c.shards[i].cacheBytes, "a bounded shard should not become unbounded")
+	}
+	require.Equal(t, int64(1), share(10, negativeCacheRatio))
+	require.Equal(t, int64(0), share(0, negativeCacheRatio), "unbounded should stay unbounded")
+}
+
+func TestNegativeCache(t *testing.T) {
+	loads := 0
+	transient := errors.New("db is down")
+	toyC := NewGroup("negative", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		if key == "down" {
+			return nil, transient
+		}
+		return nil, fmt.Errorf("%s not exist: %w", key, ErrNotFound)
+	}), WithNegativeCache(time.Minute, 50*time.Millisecond))
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := getView(toyC, ctx, "Tom")
+		require.ErrorIs(t, err, ErrNotFound)
+	}
+	require.Equal(t, 1, loads, "not found key should be remembered")
+	require.Equal(t, int64(2), toyC.Stats().NegativeHits)
+
+	_, err := getView(toyC, ctx, "down")
+	require.ErrorIs(t, err, transient)
+	_, err = getView(toyC, ctx, "down")
+	require.ErrorIs(t, err, transient)
+	require.Equal(t, 2, loads)
+	time.Sleep(60 * time.Millisecond)
+	_, err = getView(toyC, ctx, "down")
+	require.ErrorIs(t, err, transient)
+	require.Equal(t, 3, loads, "errors should be remembered for errTTL only")
+
+	require.NoError(t, toyC.Remove(ctx, "Tom"))
+	_, err = getView(toyC, ctx, "Tom")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.Equal(t, 4, loads, "removed key should be loaded again")
+}
+
+func TestNegativeCacheDisabled(t *testing.T) {
+	loads := 0
+	toyC := NewGroup("negativeOff", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return nil, ErrNotFound
+	}), WithNegativeCache(0, time.Minute))
+	for i := 0; i < 2; i++ {
+		_, err := getView(toyC, context.Background(), "Tom")
+		require.ErrorIs(t, err, ErrNotFound)
+	}
+	require.Equal(t, 2, loads, "zero notFoundTTL should not remember not found")
+}
+
+type notFoundPeer struct{ testPeer }
+
+func (p *notFoundPeer) Get(_ context.Context, in *pb.Request, out *pb.Response) error {
+	p.gets++
+	return ErrNotFound
+}
+
+func TestPeerNotFound(t *testing.T) {
+	loads := 0
+	toyC := NewGroup("peerNotFound", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}), WithNegativeCache(time.Minute, 0))
+	peer := &notFoundPeer{}
+	toyC.RegisterPeer(testPicker{peer: peer})
+	for i := 0; i < 2; i++ {
+		_, err := getView(toyC, context.Background(), "Tom")
+		require.ErrorIs(t, err, ErrNotFound)
+	}
+	require.Equal(t, 1, peer.gets)
+	require.Equal(t, 0, loads, "not found from the owner should not be loaded locally")
+	require.Equal(t, int64(0), toyC.Stats().PeerErrors)
+}
+
+func TestNegativeCacheSkipsCancelled(t *testing.T) {
+	var calls int32
+	toyC := NewGroup("negativeCancelled", 2<<10, ContextGetterFunc(func(ctx context.Context, key string) ([]byte, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// the first load outlives its timeout
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return []byte(key), nil
+	}), WithNegativeCache(time.Minute, time.Minute), WithLoadTimeout(10*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := getView(toyC, ctx, "Tom")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	cancel()
+	_, err = getView(toyC, ctx, "Tom")
+	require.ErrorIs(t, err, context.Canceled)
+
+	view, err := getView(toyC, context.Background(), "Tom")
+	require.NoError(t, err, "a cancelled or timed out load should not poison the key")
+	require.Equal(t, "Tom", view.String())
+	require.Equal(t, int64(0), toyC.Stats().NegativeHits)
+}
+
+func TestDiskTier(t *testing.T) {
+	loads := 0
+	toyC := NewGroup("diskTier", 64, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}), WithDiskTier(t.TempDir(), 1<<20))
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		_, err := getView(toyC, ctx, "key"+strconv.Itoa(i))
+		require.NoError(t, err)
+	}
+	stats := toyC.CacheStats(MainCache)
+	require.Equal(t, int64(3), stats.DiskItems, "evicted entries should be demoted")
+
+	view, err := getView(toyC, ctx, "key0")
+	require.NoError(t, err)
+	require.Equal(t, "key0", view.String())
+	require.Equal(t, 10, loads, "demoted entry should not be loaded again")
+	require.Equal(t, int64(1), toyC.CacheStats(MainCache).DiskHits)
+
+	require.NoError(t, toyC.Remove(ctx, "key1"))
+	_, err = getView(toyC, ctx, "key1")
+	require.NoError(t, err)
+	require.Equal(t, 11, loads, "removed key should be dropped from disk too")
+
+	require.NoError(t, toyC.Close())
+	for i := 0; i < 10; i++ {
+		_, err := getView(toyC, ctx, "key"+strconv.Itoa(i))
+		require.NoError(t, err, "closed group should keep serving from memory")
+	}
+	require.Equal(t, int64(1), toyC.CacheStats(MainCache).DiskHits, "closed disk tier should not be read")
+}
+
+func TestDiskTierConcurrent(t *testing.T) {
+	toyC := NewGroup("diskTierConcurrent", 256, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}), WithDiskTier(t.TempDir(), 0))
+	defer toyC.Close()
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := "key" + strconv.Itoa((i*7+w)%50)
+				if i%10 == 0 {
+					toyC.Remove(ctx, key)
+					continue
+				}
+				view, err := getView(toyC, ctx, key)
+				if err != nil || view.String() != key {
+					t.Errorf("get %s = %q, %v", key, view.String(), err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func benchmarkGet(b *testing.B, shards int) {
+	toyC := NewGroup("bench"+strconv.Itoa(shards), 64<<20, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}), WithShards(shards))
+	ctx := context.Background()
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+		getView(toyC, ctx, keys[i])
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			getView(toyC, ctx, keys[i%len(keys)])
+			i++
+		}
+	})
+}
+
+// run with -cpu 1,2,4,8 to see throughput scaling with GOMAXPROCS
+func BenchmarkGet_1Shard(b *testing.B)   { benchmarkGet(b, 1) }
+func BenchmarkGet_16Shards(b *testing.B) { benchmarkGet(b, 16) }
+
+// joinContext signals joined the first time Done is called, load calls
+// it right after joining the flight
+type joinContext struct {
+	context.Context
+	once   sync.Once
+	joined chan struct{}
+}
+
+func (c *joinContext) Done() <-chan struct{} {
+	c.once.Do(func() { close(c.joined) })
+	return c.Context.Done()
+}
+
+func TestLoadOutlivesLeader(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	var calls int32
+	toyC := NewGroup("loadLeader", 2<<10, ContextGetterFunc(func(ctx context.Context, key string) ([]byte, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return []byte(key), nil
+	}))
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := getView(toyC, leaderCtx, "Tom")
+		leader <- err
+	}()
+	<-started
+	waiterCtx := &joinContext{Context: context.Background(), joined: make(chan struct{})}
+	waiter, waiterErr := make(chan ByteView, 1), make(chan error, 1)
+	go func() {
+		view, err := getView(toyC, waiterCtx, "Tom")
+		waiterErr <- err
+		waiter <- view
+	}()
+	<-waiterCtx.joined
+
+	cancel()
+	require.ErrorIs(t, <-leader, context.Canceled, "leader should stop waiting with its ctx")
+	close(release)
+	require.NoError(t, <-waiterErr)
+	require.Equal(t, "Tom", (<-waiter).String(), "waiter should get the value loaded for the leader")
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	require.Equal(t, int64(1), toyC.Stats().LoadsDeduped)
+}